@@ -0,0 +1,64 @@
+package benchmark
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/AgilaNews/bfserver/bloom"
+)
+
+// goroutinePerKeyTest is how BatchTest worked before the worker pool, kept
+// as the baseline
+func goroutinePerKeyTest(f bloom.Filter, keys []string) []bool {
+	type result struct {
+		index  int
+		exists bool
+	}
+
+	ret := make([]bool, len(keys))
+	ch := make(chan result, len(keys))
+	for i := 0; i < len(keys); i++ {
+		go func(idx int, key []byte) {
+			ch <- result{idx, f.Test(key)}
+		}(i, []byte(keys[i]))
+	}
+
+	for i := 0; i < len(keys); i++ {
+		r := <-ch
+		ret[r.index] = r.exists
+	}
+
+	return ret
+}
+
+func batchFixture(n int) (bloom.Filter, []string) {
+	f, _ := bloom.NewClassicBloomFilter(bloom.FilterOptions{Name: BF_NAME, N: 100000, ErrorRate: 0.01})
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	bloom.BatchAdd(f, keys[:n/2], true)
+
+	return f, keys
+}
+
+func benchmarkGoroutinePerKey(b *testing.B, n int) {
+	f, keys := batchFixture(n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		goroutinePerKeyTest(f, keys)
+	}
+}
+
+func benchmarkWorkerPool(b *testing.B, n int) {
+	f, keys := batchFixture(n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bloom.BatchTest(f, keys)
+	}
+}
+
+func BenchmarkBatchTest10GoroutinePerKey(b *testing.B)    { benchmarkGoroutinePerKey(b, 10) }
+func BenchmarkBatchTest10WorkerPool(b *testing.B)         { benchmarkWorkerPool(b, 10) }
+func BenchmarkBatchTest10000GoroutinePerKey(b *testing.B) { benchmarkGoroutinePerKey(b, 10000) }
+func BenchmarkBatchTest10000WorkerPool(b *testing.B)      { benchmarkWorkerPool(b, 10000) }
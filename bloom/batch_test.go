@@ -88,3 +88,103 @@ func TestBatchTest(t *testing.T) {
 		return
 	}
 }
+
+func TestBatchTestAndAdd(t *testing.T) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i%500)
+	}
+
+	filter, err := NewClassicBloomFilter(FilterOptions{Name: "test", ErrorRate: 0.001, N: 100000})
+	if err != nil {
+		t.Errorf("create classic filter error: %v", err)
+		return
+	}
+
+	ret, exists := BatchTestAndAdd(filter, keys)
+	if len(ret) != len(keys) {
+		t.Errorf("return length error")
+		return
+	}
+
+	// every key appears twice, exactly one of them is reported as new
+	if exists != 500 {
+		t.Errorf("expected 500 exists, got %d", exists)
+	}
+
+	if filter.Count() != 500 {
+		t.Errorf("expected 500 added, got %d", filter.Count())
+	}
+}
+
+// Ensures that multi filter requests fail per entry.
+func TestManagerMultiTestAdd(t *testing.T) {
+	m, _ := NewFilterManager(nil, 0)
+	m.AddNewBloomFilter(FILTER_CLASSIC, FilterOptions{Name: "a", ErrorRate: 0.01, N: 1000})
+	m.AddNewBloomFilter(FILTER_CLASSIC, FilterOptions{Name: "b", ErrorRate: 0.01, N: 1000})
+
+	errs := m.MultiAdd([]MultiEntry{
+		{Name: "a", Keys: []string{"1", "2"}},
+		{Name: "missing", Keys: []string{"1"}},
+		{Name: "b", Keys: []string{"3"}},
+	})
+	if errs[0] != nil || errs[1] == nil || errs[2] != nil {
+		t.Errorf("multi add errors unexpected: %v", errs)
+	}
+
+	results := m.MultiTest([]MultiEntry{
+		{Name: "a", Keys: []string{"1", "3"}},
+		{Name: "missing", Keys: []string{"1"}},
+		{Name: "b", Keys: []string{"1", "3"}},
+	})
+	if results[0].Err != nil || !results[0].Exists[0] || results[0].Exists[1] || results[0].Count != 1 {
+		t.Errorf("multi test of a error: %+v", results[0])
+	}
+	if results[1].Err == nil {
+		t.Errorf("multi test of missing filter should fail")
+	}
+	if results[2].Err != nil || results[2].Exists[0] || !results[2].Exists[1] {
+		t.Errorf("multi test of b error: %+v", results[2])
+	}
+}
+
+// Ensures that every item is visited once whatever the batch size.
+func TestRunSharded(t *testing.T) {
+	for _, n := range []int{0, 1, SEQUENTIAL_BATCH_SIZE, SEQUENTIAL_BATCH_SIZE + 1, 10007} {
+		visited := make([]int32, n)
+		runSharded(n, func(start, end int) {
+			for i := start; i < end; i++ {
+				visited[i]++
+			}
+		})
+
+		for i, v := range visited {
+			if v != 1 {
+				t.Errorf("item %d of %d visited %d times", i, n, v)
+				break
+			}
+		}
+	}
+}
+
+// Ensures that large batches keep results in order of keys.
+func TestBatchTestLarge(t *testing.T) {
+	filter, _ := NewClassicBloomFilter(FilterOptions{Name: "test", ErrorRate: 0.001, N: 20000})
+
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	BatchAdd(filter, keys[:5000], true)
+
+	ret, exists := BatchTest(filter, keys)
+	for i := 0; i < 5000; i++ {
+		if !ret[i] {
+			t.Errorf("key %d should exist", i)
+			break
+		}
+	}
+	if exists < 5000 || exists > 5050 {
+		t.Errorf("exists count error: %d", exists)
+	}
+}
@@ -0,0 +1,216 @@
+package bloom
+
+/*
+ *  @Describe: word aligned bit array for 1-bit buckets
+ */
+
+import (
+	"encoding/binary"
+	"io"
+	"math/bits"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/alecthomas/log4go"
+)
+
+const (
+	BITSET_CHUNK_WORDS = 4096 // words converted at once when dumping and loading
+)
+
+// Bitset is a bit array of words, bits are set by atomic CAS and read by
+// atomic loads, so Set and Get are safe to call concurrently without locks.
+// Bit i is bit (i%64) of word (i/64), so the little endian bytes of words
+// are the same as data of 1-bit Buckets, and it dumps as Buckets.
+type Bitset struct {
+	words []uint64
+	count uint
+}
+
+func NewBitset(count uint) *Bitset {
+	return &Bitset{
+		words: alignedWords((count + 63) / 64),
+		count: count,
+	}
+}
+
+// alignedWords allocates n words starting at a cache line
+func alignedWords(n uint) []uint64 {
+	const lineWords = 8
+
+	buf := make([]uint64, n+lineWords-1)
+	offset := 0
+	if mis := uintptr(unsafe.Pointer(&buf[0])) % (lineWords * 8); mis != 0 {
+		offset = int(lineWords - mis/8)
+	}
+
+	return buf[offset : offset+int(n) : offset+int(n)]
+}
+
+// newBitsetOfBytes creates bitset from data of 1-bit Buckets
+func newBitsetOfBytes(count uint, data []byte) *Bitset {
+	b := NewBitset(count)
+	buf := make([]byte, 8)
+
+	for i := range b.words {
+		n := copy(buf, data[i*8:])
+		for j := n; j < 8; j++ {
+			buf[j] = 0
+		}
+		b.words[i] = binary.LittleEndian.Uint64(buf)
+	}
+
+	return b
+}
+
+func (b *Bitset) Count() uint {
+	return b.count
+}
+
+func (b *Bitset) Storage() uint64 {
+	return uint64(len(b.words)) * 8
+}
+
+func (b *Bitset) Get(i uint) bool {
+	return atomic.LoadUint64(&b.words[i/64])&(1<<(i%64)) != 0
+}
+
+// Set sets bit i, returns whether it was set before
+func (b *Bitset) Set(i uint) bool {
+	addr := &b.words[i/64]
+	mask := uint64(1) << (i % 64)
+
+	for {
+		old := atomic.LoadUint64(addr)
+		if old&mask != 0 {
+			return true
+		}
+		if atomic.CompareAndSwapUint64(addr, old, old|mask) {
+			return false
+		}
+	}
+}
+
+func (b *Bitset) Reset() {
+	for i := range b.words {
+		atomic.StoreUint64(&b.words[i], 0)
+	}
+}
+
+// ones returns number of bits set
+func (b *Bitset) ones() uint {
+	n := 0
+	for i := range b.words {
+		n += bits.OnesCount64(atomic.LoadUint64(&b.words[i]))
+	}
+	return uint(n)
+}
+
+// union ors bits of other bitset of the same count into b
+func (b *Bitset) union(other *Bitset) {
+	for i := range b.words {
+		b.update(i, atomic.LoadUint64(&other.words[i]), false)
+	}
+}
+
+// intersect ands bits of other bitset of the same count into b
+func (b *Bitset) intersect(other *Bitset) {
+	for i := range b.words {
+		b.update(i, atomic.LoadUint64(&other.words[i]), true)
+	}
+}
+
+func (b *Bitset) update(i int, v uint64, and bool) {
+	for {
+		old := atomic.LoadUint64(&b.words[i])
+		word := old | v
+		if and {
+			word = old & v
+		}
+
+		if old == word || atomic.CompareAndSwapUint64(&b.words[i], old, word) {
+			return
+		}
+	}
+}
+
+func (b *Bitset) Dump(stream io.Writer) error {
+	w := newBinWriter(stream)
+
+	length := (uint64(b.count) + 7) / 8
+	writeBucketsHeader(w, 1, uint64(b.count), length)
+
+	buf := make([]byte, 8*BITSET_CHUNK_WORDS)
+	for i := 0; i < len(b.words); i += BITSET_CHUNK_WORDS {
+		n := 0
+		for j := i; j < len(b.words) && j < i+BITSET_CHUNK_WORDS; j++ {
+			binary.LittleEndian.PutUint64(buf[n:], atomic.LoadUint64(&b.words[j]))
+			n += 8
+		}
+
+		// last word may be partial
+		if left := length - uint64(i)*8; uint64(n) > left {
+			n = int(left)
+		}
+		w.Write(buf[:n])
+	}
+	w.Pad(8)
+
+	return w.err
+}
+
+func (b *Bitset) Load(stream io.Reader) error {
+	r := newBinReader(stream)
+
+	size, count, length, err := readBucketsHeader(r)
+	if err != nil {
+		return err
+	}
+	if size != 1 {
+		log4go.Warn("illegal bitset, bits per bucket is %d", size)
+		return ILLEGAL_LOAD_FORMAT
+	}
+
+	// count isn't checked by crc yet, words grow as read so a corrupted one
+	// fails at the end of stream rather than allocating it all
+	total := (count + 63) / 64
+	words := alignedWords(0)
+
+	buf := make([]byte, 8*BITSET_CHUNK_WORDS)
+	for i := uint64(0); i < total && r.err == nil; i += BITSET_CHUNK_WORDS {
+		n := uint64(len(buf))
+		if left := length - i*8; n > left {
+			n = left
+		}
+
+		r.Read(buf[:n])
+		for j := n; j < uint64(len(buf)); j++ {
+			buf[j] = 0
+		}
+
+		end := i + BITSET_CHUNK_WORDS
+		if end > total {
+			end = total
+		}
+		if uint64(cap(words)) < end {
+			grown := alignedWords(uint(growCap(uint64(cap(words)), end, total)))
+			copy(grown, words)
+			words = grown[:len(words)]
+		}
+
+		words = words[:end]
+		for j := i; j < end; j++ {
+			words[j] = binary.LittleEndian.Uint64(buf[(j-i)*8:])
+		}
+	}
+	r.Pad(8)
+
+	if r.err != nil {
+		log4go.Info("load bitset error: %+v", r.err)
+		return r.err
+	}
+
+	b.words = words
+	b.count = uint(count)
+	return nil
+}
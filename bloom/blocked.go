@@ -0,0 +1,253 @@
+package bloom
+
+/*
+ *  @Describe: cache-blocked bloomfilter, all k bits of a key are in one
+ *  512-bit block, so a test touches one cache line. Blocks are not filled
+ *  evenly, crowded ones give more false positives, so it's sized by the
+ *  error rate over blocks and needs a bit more memory than classic filter.
+ */
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/alecthomas/log4go"
+)
+
+const (
+	BLOCK_BITS = 512 // a cache line
+)
+
+type BlockedBloomFilter struct {
+	mu sync.Mutex // serializes TestAndAdd
+
+	name      string
+	m         uint    // filter size, multiple of BLOCK_BITS
+	k         uint    // number of hash functions
+	count     uint64  // number of items added, accessed atomically
+	errorRate float64 // configured false positive rate
+	hash      byte    // kind of hash function
+
+	bits *Bitset // filter data
+}
+
+func NewBlockedBloomFilter(options FilterOptions) (Filter, error) {
+	if options.ErrorRate == 0 || options.N == 0 {
+		return nil, fmt.Errorf("illegal params")
+	}
+
+	hash, err := hashKindOf(options.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	k := OptimalK(options.ErrorRate)
+	m := (OptimalM(options.N, options.ErrorRate) + BLOCK_BITS - 1) / BLOCK_BITS * BLOCK_BITS
+	for blockedErrorRate(m, k, options.N) > options.ErrorRate {
+		m += (m/64 + BLOCK_BITS - 1) / BLOCK_BITS * BLOCK_BITS
+	}
+
+	return &BlockedBloomFilter{
+		name:      options.Name,
+		bits:      NewBitset(m),
+		m:         m,
+		k:         k,
+		errorRate: options.ErrorRate,
+		hash:      hash,
+	}, nil
+}
+
+// blockedErrorRate returns false positive rate of n keys in m bits, keys in
+// a block are poisson distributed and each sets k random bits of its block
+func blockedErrorRate(m, k, n uint) float64 {
+	lambda := float64(n) * BLOCK_BITS / float64(m)
+	limit := int(lambda + 10*math.Sqrt(lambda) + 20)
+
+	rate := 0.0
+	p := math.Exp(-lambda) // probability of j keys in a block
+	for j := 0; j <= limit; j++ {
+		if j > 0 {
+			p *= lambda / float64(j)
+		}
+
+		rate += p * math.Pow(1-math.Pow(1-1.0/BLOCK_BITS, float64(j*int(k))), float64(k))
+	}
+
+	return rate
+}
+
+func (b *BlockedBloomFilter) Name() string {
+	return b.name
+}
+
+func (b *BlockedBloomFilter) Capacity() uint {
+	return b.m
+}
+
+func (b *BlockedBloomFilter) K() uint {
+	return b.k
+}
+
+func (b *BlockedBloomFilter) Count() uint {
+	return uint(atomic.LoadUint64(&b.count))
+}
+
+func (b *BlockedBloomFilter) ErrorRate() float64 {
+	return b.errorRate
+}
+
+func (b *BlockedBloomFilter) Storage() uint64 {
+	return b.bits.Storage()
+}
+
+func (b *BlockedBloomFilter) EstimatedFillRatio() float64 {
+	return 1 - math.Exp((-float64(b.Count())*float64(b.k))/float64(b.m))
+}
+
+func (b *BlockedBloomFilter) FillRatio() float64 {
+	return float64(b.bits.ones()) / float64(b.m)
+}
+
+func (b *BlockedBloomFilter) PeriodMaintaince(persister FilterPersister, force bool) error {
+	if force {
+		log4go.Info("period dump blocked bloom filter: %s", b.name)
+		return persistFilter(persister, b)
+	}
+
+	return nil
+}
+
+// blockProbes gives locations of a key in its block, 9 bits each from the
+// hash, which is mixed again once used up. Locations are independent, unlike
+// double hashing in a block which gives keys of the same step shared bits.
+type blockProbes struct {
+	h    uint64
+	bits uint64
+	left uint
+}
+
+func (p *blockProbes) next() uint {
+	if p.left == 0 {
+		p.h = fmix64(p.h)
+		p.bits = p.h
+		p.left = 64 / 9
+	}
+
+	location := uint(p.bits % BLOCK_BITS)
+	p.bits /= BLOCK_BITS
+	p.left--
+	return location
+}
+
+// block returns the first bit of block of key, and probes of locations in
+// the block
+func (b *BlockedBloomFilter) block(data []byte) (uint, blockProbes) {
+	h1, h2 := hashKeys(b.hash, data)
+
+	return uint(h1%uint64(b.m/BLOCK_BITS)) * BLOCK_BITS, blockProbes{h: h2}
+}
+
+func (b *BlockedBloomFilter) Test(data []byte) bool {
+	base, probes := b.block(data)
+
+	for i := uint(0); i < b.k; i++ {
+		if !b.bits.Get(base + probes.next()) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (b *BlockedBloomFilter) Add(data []byte) Filter {
+	b.add(data)
+	atomic.AddUint64(&b.count, 1)
+	return b
+}
+
+// add sets bits of key, returns whether all of them were set before
+func (b *BlockedBloomFilter) add(data []byte) bool {
+	base, probes := b.block(data)
+	exists := true
+
+	for i := uint(0); i < b.k; i++ {
+		if !b.bits.Set(base + probes.next()) {
+			exists = false
+		}
+	}
+
+	return exists
+}
+
+func (b *BlockedBloomFilter) TestAndAdd(data []byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	exists := b.add(data)
+	if !exists {
+		atomic.AddUint64(&b.count, 1)
+	}
+
+	return exists
+}
+
+func (b *BlockedBloomFilter) Reset() {
+	b.bits.Reset()
+	atomic.StoreUint64(&b.count, 0)
+}
+
+func (b *BlockedBloomFilter) Load(stream io.Reader) error {
+	r := newBinReader(stream)
+	t, meta := r.Section()
+	if r.err != nil || t != SECTION_BLOCKED {
+		log4go.Warn("read blocked bloom filter header error")
+		return ILLEGAL_LOAD_FORMAT
+	}
+
+	b.name = meta.String()
+	b.m = uint(meta.U64())
+	b.k = uint(meta.U32())
+	b.count = meta.U64()
+	b.errorRate = meta.F64()
+	b.hash = meta.U8()
+	if hashName(b.hash) == "" {
+		log4go.Warn("unknown hash kind %d", b.hash)
+		return ILLEGAL_LOAD_FORMAT
+	}
+	b.bits = &Bitset{}
+	log4go.Info("loaded blocked filter name:%s k:%d m:%d count:%d", b.name, b.k, b.m, b.count)
+
+	if err := b.bits.Load(r); err != nil {
+		return err
+	}
+	if b.bits.Count() != b.m || b.m == 0 || b.m%BLOCK_BITS != 0 {
+		log4go.Warn("bitset count %d mismatch m %d", b.bits.Count(), b.m)
+		return ILLEGAL_LOAD_FORMAT
+	}
+
+	return nil
+}
+
+func (b *BlockedBloomFilter) Dump(stream io.Writer) error {
+	w := newBinWriter(stream)
+
+	count := b.Count()
+	w.Section(SECTION_BLOCKED, func(meta *binWriter) {
+		meta.String(b.name)
+		meta.U64(uint64(b.m))
+		meta.U32(uint32(b.k))
+		meta.U64(uint64(count))
+		meta.F64(b.errorRate)
+		meta.U8(b.hash)
+	})
+	if w.err != nil {
+		log4go.Warn("encode error: %v", w.err)
+		return w.err
+	}
+	log4go.Info("dumped blocked filter header with name:%s k:%d m:%d count:%d", b.name, b.k, b.m, count)
+
+	return b.bits.Dump(w)
+}
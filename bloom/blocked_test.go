@@ -0,0 +1,128 @@
+package bloom
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+// Ensures that added keys are members and false positive rate is close to
+// the configured one.
+func TestBlockedBloomTestAndAdd(t *testing.T) {
+	f, err := NewBlockedBloomFilter(FilterOptions{Name: "test", N: 10000, ErrorRate: 0.01})
+	if err != nil {
+		t.Fatalf("create blocked filter error: %v", err)
+	}
+	if m := f.Capacity(); m%BLOCK_BITS != 0 {
+		t.Errorf("capacity %d should be a multiple of %d", m, BLOCK_BITS)
+	}
+
+	for i := 0; i < 10000; i++ {
+		f.TestAndAdd([]byte(strconv.Itoa(i)))
+	}
+	for i := 0; i < 10000; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("%d should be a member", i)
+		}
+	}
+
+	if rate := falsePositiveRate(f, 10000, 100000); rate > 0.02 {
+		t.Errorf("false positive rate %f is too high", rate)
+	}
+
+	if !f.TestAndAdd([]byte("1")) {
+		t.Error("1 should exist")
+	}
+
+	f.Reset()
+	if f.Count() != 0 || f.Test([]byte("1")) {
+		t.Error("filter should be empty after reset")
+	}
+}
+
+// Ensures that false positive rate of blocked filter meets the configured one.
+func TestBlockedBloomFalsePositive(t *testing.T) {
+	for _, hash := range []string{HASH_FNV64, HASH_MURMUR3, HASH_XXHASH} {
+		for _, errorRate := range []float64{0.01, 0.001} {
+			f, _ := NewBlockedBloomFilter(FilterOptions{Name: "test", N: 20000, ErrorRate: errorRate, Hash: hash})
+			for i := 0; i < 20000; i++ {
+				f.Add([]byte(strconv.Itoa(i)))
+			}
+
+			// allow for sampling error of tests
+			if rate := falsePositiveRate(f, 20000, 500000); rate > errorRate*1.1 {
+				t.Errorf("false positive rate %f with hash %s exceeds %f", rate, hash, errorRate)
+			}
+		}
+	}
+}
+
+// Ensures that blocked filter survives dump and load.
+func TestBlockedBloomDumpLoad(t *testing.T) {
+	f, _ := NewBlockedBloomFilter(FilterOptions{Name: "test", N: 1000, ErrorRate: 0.01, Hash: HASH_XXHASH})
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	buf := &bytes.Buffer{}
+	if err := WriteDump(buf, f); err != nil {
+		t.Fatalf("dump error: %v", err)
+	}
+
+	loaded, _, err := LoadDump(buf)
+	if err != nil {
+		t.Fatalf("load error: %v", err)
+	}
+
+	l, ok := loaded.(*BlockedBloomFilter)
+	if !ok {
+		t.Fatalf("expected blocked filter, got %s", filterType(loaded))
+	}
+	if l.Name() != "test" || l.Capacity() != f.Capacity() || l.K() != f.K() || l.Count() != 1000 {
+		t.Errorf("loaded filter mismatch, name:%s m:%d k:%d count:%d", l.Name(), l.Capacity(), l.K(), l.Count())
+	}
+	if HashOf(l) != HASH_XXHASH {
+		t.Errorf("expected hash %s, got %s", HASH_XXHASH, HashOf(l))
+	}
+	for i := 0; i < 1000; i++ {
+		if !l.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("%d should be a member", i)
+		}
+	}
+}
+
+// falsePositiveRate tests keys from n to n+tests which were never added
+func falsePositiveRate(f Filter, n, tests int) float64 {
+	fp := 0
+	for i := n; i < n+tests; i++ {
+		if f.Test([]byte(strconv.Itoa(i))) {
+			fp++
+		}
+	}
+
+	return float64(fp) / float64(tests)
+}
+
+func benchmarkFilterTest(b *testing.B, t string) {
+	b.StopTimer()
+	n := 10000000
+	f, _ := NewFilter(t, FilterOptions{N: uint(n), ErrorRate: 0.01})
+	for i := 0; i < n; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+	data := make([][]byte, b.N)
+	for i := 0; i < b.N; i++ {
+		data[i] = []byte(strconv.Itoa(n + i))
+	}
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		f.Test(data[i])
+	}
+
+	b.StopTimer()
+	b.ReportMetric(falsePositiveRate(f, n, 100000), "fp-rate")
+}
+
+func BenchmarkBlockedTest(b *testing.B) { benchmarkFilterTest(b, FILTER_BLOCKED) }
+func BenchmarkClassicTest(b *testing.B) { benchmarkFilterTest(b, FILTER_CLASSIC) }
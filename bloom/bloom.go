@@ -4,29 +4,53 @@ import (
 	"bufio"
 	"compress/gzip"
 	"encoding/binary"
-	"encoding/gob"
 	"fmt"
+	"hash/crc32"
 	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"math"
 	"os"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/AgilaNews/bfserver/metrics"
 	"github.com/alecthomas/log4go"
 )
 
 const (
 	DEFAULT_FILL_RATIO = 0.5
 
-	FILTER_CLASSIC = "classic"
-	FILTER_ROTATED = "rotated"
-	MAGIC_NUM      = 0x123553f3
+	FILTER_CLASSIC  = "classic"
+	FILTER_ROTATED  = "rotated"
+	FILTER_COUNTING = "counting"
+	FILTER_SCALABLE = "scalable"
+	FILTER_BLOCKED  = "blocked"
+	FILTER_CUCKOO   = "cuckoo"
+	FILTER_TTL      = "ttl"
+	MAGIC_NUM       = 0x123553f3
+
+	MERGE_UNION     = "union"
+	MERGE_INTERSECT = "intersect"
+
+	// gob dumps before versioning are decoded as version 0, which have no checksum
+	DUMP_VERSION_LEGACY   = 0
+	DUMP_VERSION_CHECKSUM = 1
+	DUMP_VERSION_BINARY   = 2
+	DUMP_VERSION          = DUMP_VERSION_BINARY
+
+	ROTATE_CHECK_PERIOD  = time.Minute      // longest wait of rotation scheduler
+	INFOS_REFRESH_PERIOD = 10 * time.Second // period of refreshing costly infos of filters
 )
 
 var (
-	ILLEGAL_LOAD_FORMAT = fmt.Errorf("illegal load format")
-	DUMP_ERROR          = fmt.Errorf("dump error")
+	ILLEGAL_LOAD_FORMAT  = fmt.Errorf("illegal load format")
+	DUMP_ERROR           = fmt.Errorf("dump error")
+	CHECKSUM_ERROR       = fmt.Errorf("checksum mismatch")
+	FILTER_FULL_ERROR    = fmt.Errorf("filter is full")
+	FILTER_DELETED_ERROR = fmt.Errorf("filter is deleted or reloaded")
+	ROTATED_ERROR        = fmt.Errorf("filter rotated while dumping")
 
 	Manager *FilterManager
 	UseGzip = true
@@ -37,9 +61,13 @@ type FilterOptions struct {
 
 	N         uint
 	ErrorRate float64
+	Hash      string // HASH_FNV64 if empty
 
 	R              uint
 	RotateInterval time.Duration
+	NewestOnly     bool // rotated filter adds keys to the newest generation only
+
+	TTL time.Duration // keys of ttl filter expire after it
 }
 
 type FilterManager struct {
@@ -52,6 +80,17 @@ type FilterManager struct {
 	Filters  map[string]Filter
 	TotalMem uint64
 
+	logs map[string]*AddLog
+
+	// held by delete, and by dumps while they replace the snapshot, so a
+	// dump of deleted filter never recreates its files
+	deleting sync.RWMutex
+
+	// infos of filters by name refreshed every INFOS_REFRESH_PERIOD, so
+	// metrics scrapes don't scan buckets of filters
+	infos     map[string]cachedInfo
+	infosLock sync.RWMutex
+
 	forceDumpPeriod time.Duration
 	lastForce       time.Time
 }
@@ -60,11 +99,43 @@ type DumpHeader struct {
 	Magic          uint //magic number of dump header
 	FilterUsedGzip bool
 	FilterType     string //filter type
+	Version        uint   //dump format version
+	LogStart       int64  //first add log segment not in the dump, zero for all
+}
+
+type FilterInfo struct {
+	Name string
+	Type string
+
+	Capacity           uint
+	K                  uint
+	Count              uint
+	ErrorRate          float64
+	FillRatio          float64
+	EstimatedFillRatio float64
+	Storage            uint64
+	Hash               string
+
+	//only for rotated filter
+	R              uint
+	Current        uint
+	RotateInterval time.Duration
+	LastRotated    time.Time
+	NextRotation   time.Time
+	WindowStart    time.Time // keys added since it are members
+	NewestOnly     bool
+
+	//only for scalable filter
+	Stages uint
+
+	//only for ttl filter
+	TTL time.Duration
 }
 
 type Filter interface {
 	Test([]byte) bool
 	Add([]byte) Filter
+	TestAndAdd([]byte) bool //add key if not exists, returns if it existed
 
 	Reset()
 	PeriodMaintaince(persister FilterPersister, force bool) error
@@ -74,14 +145,43 @@ type Filter interface {
 	Capacity() uint
 	K() uint
 	Count() uint
+	ErrorRate() float64
 	EstimatedFillRatio() float64
 	FillRatio() float64
+	Storage() uint64 //bytes used by buckets
 
 	//persist
 	Load(reader io.Reader) error
 	Dump(writer io.Writer) error
 }
 
+// MergeableFilter can be combined with filters of the same type and params
+type MergeableFilter interface {
+	Filter
+
+	Union(other Filter) error
+	Intersect(other Filter) error
+
+	// CheckMerge returns the error merging other would fail with, without merging
+	CheckMerge(other Filter) error
+}
+
+// RemovableFilter is a filter which supports deleting keys
+type RemovableFilter interface {
+	Filter
+
+	Remove([]byte) bool
+}
+
+// InsertableFilter is a filter whose adding may fail, e.g. when it's full,
+// Add and TestAndAdd of it drop such keys with a warning
+type InsertableFilter interface {
+	Filter
+
+	Insert([]byte) error
+	TestAndInsert([]byte) (bool, error)
+}
+
 func OptimalM(n uint, fpRate float64) uint {
 	return uint(math.Ceil(float64(n) / ((math.Log(DEFAULT_FILL_RATIO) *
 		math.Log(1-DEFAULT_FILL_RATIO)) / math.Abs(math.Log(fpRate)))))
@@ -99,55 +199,111 @@ func hashKernel(data []byte) (uint32, uint32) {
 	return binary.BigEndian.Uint32(sum[4:8]), binary.BigEndian.Uint32(sum[0:4])
 }
 
-func BatchAdd(f Filter, keys []string, wait bool) {
+// BatchAdd adds keys to f, errors of insertable filter are returned only if it
+// waits, or else they are logged
+func BatchAdd(f Filter, keys []string, wait bool) error {
+	var errs []error
+	add := func() {
+		runSharded(len(keys), func(start, end int) {
+			for _, key := range keys[start:end] {
+				f.Add([]byte(key))
+			}
+		})
+	}
+
+	if insertable, ok := f.(InsertableFilter); ok {
+		errs = make([]error, len(keys))
+		add = func() {
+			runSharded(len(keys), func(start, end int) {
+				for i := start; i < end; i++ {
+					errs[i] = insertable.Insert([]byte(keys[i]))
+				}
+			})
+		}
+	}
 
 	if wait {
-		ch := make(chan bool, len(keys))
-		for i, key := range keys {
-			go func(i int, b []byte) {
-				f.Add(b)
+		add()
+		return insertError(f, errs)
+	}
+
+	go func() {
+		add()
+		if err := insertError(f, errs); err != nil {
+			log4go.Warn("async add keys error: %v", err)
+		}
+	}()
+	return nil
+}
+
+func BatchTestAndAdd(f Filter, keys []string) ([]bool, int) {
+	return batchTest(keys, f.TestAndAdd)
+}
+
+// batchTestAndInsert is BatchTestAndAdd of insertable filter, which also
+// reports keys failed to add
+func batchTestAndInsert(f InsertableFilter, keys []string) ([]bool, int, error) {
+	ret := make([]bool, len(keys))
+	errs := make([]error, len(keys))
 
-				ch <- true
-			}(i, []byte(key))
+	runSharded(len(keys), func(start, end int) {
+		for i := start; i < end; i++ {
+			ret[i], errs[i] = f.TestAndInsert([]byte(keys[i]))
 		}
+	})
 
-		for i := 0; i < len(keys); i++ {
-			<-ch
+	exists := 0
+	for _, e := range ret {
+		if e {
+			exists++
 		}
-	} else {
-		for i := 0; i < len(keys); i++ {
-			go func(idx int) {
-				f.Add([]byte(keys[idx]))
-			}(i)
+	}
+
+	return ret, exists, insertError(f, errs)
+}
+
+// insertError summarizes errors of keys added to f
+func insertError(f Filter, errs []error) error {
+	var first error
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
 		}
 	}
+
+	if failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d keys not added to %s: %v", failed, len(errs), f.Name(), first)
 }
 
-type test_result struct {
-	index  int
-	exists bool
+func BatchRemove(f RemovableFilter, keys []string) ([]bool, int) {
+	return batchTest(keys, f.Remove)
 }
 
 func BatchTest(f Filter, keys []string) ([]bool, int) {
+	return batchTest(keys, f.Test)
+}
+
+// batchTest calls fn with keys on the worker pool, returns results in order of
+// keys and count of true
+func batchTest(keys []string, fn func([]byte) bool) ([]bool, int) {
 	ret := make([]bool, len(keys))
-	chs := make(chan test_result, len(keys))
 
-	for i := 0; i < len(keys); i++ {
-		go func(idx int, key []byte) {
-			chs <- test_result{
-				index:  idx,
-				exists: f.Test(key),
-			}
-		}(i, []byte(keys[i]))
-	}
+	runSharded(len(keys), func(start, end int) {
+		for i := start; i < end; i++ {
+			ret[i] = fn([]byte(keys[i]))
+		}
+	})
 
 	trues := 0
-
-	for i := 0; i < len(keys); i++ {
-		result := <-chs
-		ret[result.index] = result.exists
-		if ret[result.index] {
-			trues += 1
+	for _, exists := range ret {
+		if exists {
+			trues++
 		}
 	}
 
@@ -157,6 +313,7 @@ func BatchTest(f Filter, keys []string) ([]bool, int) {
 func NewFilterManager(persister FilterPersister, forceDumpSeconds int) (*FilterManager, error) {
 	return &FilterManager{
 		Filters:         make(map[string]Filter),
+		logs:            make(map[string]*AddLog),
 		persister:       persister,
 		stop:            make(chan bool),
 		forceDumpPeriod: time.Duration(forceDumpSeconds) * time.Second,
@@ -170,14 +327,33 @@ func isOptionsValid(options FilterOptions) error {
 	return nil
 }
 
-func (m *FilterManager) AddNewBloomFilter(t string, options FilterOptions) (Filter, error) {
-	var filter Filter
-	var err error
-
-	if err = isOptionsValid(options); err != nil {
+// NewFilter creates a filter of type t, it is not managed by any manager
+func NewFilter(t string, options FilterOptions) (Filter, error) {
+	if err := isOptionsValid(options); err != nil {
 		return nil, err
 	}
 
+	switch t {
+	case FILTER_CLASSIC:
+		return NewClassicBloomFilter(options)
+	case FILTER_ROTATED:
+		return NewRotatedBloomFilter(options)
+	case FILTER_COUNTING:
+		return NewCountingBloomFilter(options)
+	case FILTER_SCALABLE:
+		return NewScalableBloomFilter(options)
+	case FILTER_BLOCKED:
+		return NewBlockedBloomFilter(options)
+	case FILTER_CUCKOO:
+		return NewCuckooFilter(options)
+	case FILTER_TTL:
+		return NewTTLBloomFilter(options)
+	default:
+		return nil, fmt.Errorf("invalid bf type: %s", t)
+	}
+}
+
+func (m *FilterManager) AddNewBloomFilter(t string, options FilterOptions) (Filter, error) {
 	m.Lock()
 	defer m.Unlock()
 
@@ -185,13 +361,19 @@ func (m *FilterManager) AddNewBloomFilter(t string, options FilterOptions) (Filt
 		return nil, fmt.Errorf("bloom filter exists")
 	}
 
-	switch t {
-	case FILTER_CLASSIC:
-		filter, err = NewClassicBloomFilter(options)
-	case FILTER_ROTATED:
-		filter, err = NewRotatedBloomFilter(options)
-	default:
-		return nil, fmt.Errorf("invalid bf type: %s", t)
+	filter, err := NewFilter(t, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if UseWAL && m.persister != nil {
+		l, err := m.persister.OpenLog(options.Name)
+		if err != nil {
+			return nil, err
+		}
+		if l != nil {
+			m.logs[options.Name] = l
+		}
 	}
 
 	m.Filters[options.Name] = filter
@@ -199,6 +381,328 @@ func (m *FilterManager) AddNewBloomFilter(t string, options FilterOptions) (Filt
 	return filter, nil
 }
 
+func (m *FilterManager) getFilterAndLog(name string) (Filter, *AddLog, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	f, ok := m.Filters[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("filter non exists")
+	}
+
+	return f, m.logs[name], nil
+}
+
+// AddKeys logs keys before adding them to filter, so acknowledged keys
+// survive a crash, keys of async adds may still be lost
+func (m *FilterManager) AddKeys(name string, keys []string, wait bool) error {
+	filter, l, err := m.getFilterAndLog(name)
+	if err != nil {
+		return err
+	}
+
+	return addKeys(filter, l, keys, wait)
+}
+
+func addKeys(filter Filter, l *AddLog, keys []string, wait bool) error {
+	if l != nil {
+		l.RLock()
+		defer l.RUnlock()
+
+		if err := l.Append(LOG_OP_ADD, keys); err != nil {
+			return err
+		}
+	}
+
+	return BatchAdd(filter, keys, wait)
+}
+
+// MultiEntry is keys of one filter in a multi filter request
+type MultiEntry struct {
+	Name  string
+	Keys  []string
+	Async bool      // add only
+	Scope TestScope // test only
+}
+
+// TestScope limits tests of a rotated filter to its newest generations, so one
+// filter answers both "seen in 24h" and "seen in 7 days", zero value tests the
+// whole window
+type TestScope struct {
+	Generations uint          // newest such generations
+	Within      time.Duration // generations covering keys added within it
+}
+
+// ScopeFilter returns filter whose Test and TestAndAdd are limited by scope,
+// only rotated filter can be scoped
+func ScopeFilter(filter Filter, scope TestScope) (Filter, error) {
+	if scope == (TestScope{}) {
+		return filter, nil
+	}
+
+	f, ok := filter.(*RotatedBloomFilter)
+	if !ok {
+		return nil, fmt.Errorf("can't test %s filter %s by generations", filterType(filter), filter.Name())
+	}
+	if scope.Generations > 0 && scope.Within > 0 {
+		return nil, fmt.Errorf("generations and within can't be both set")
+	}
+
+	n := scope.Generations
+	if scope.Within > 0 {
+		n = f.GenerationsWithin(scope.Within)
+	}
+
+	return &scopedFilter{RotatedBloomFilter: f, n: n}, nil
+}
+
+type MultiResult struct {
+	Exists []bool
+	Count  int // existed keys
+	Err    error
+}
+
+// getFiltersAndLogs resolves all names under one lock, errors are per name
+func (m *FilterManager) getFiltersAndLogs(entries []MultiEntry) ([]Filter, []*AddLog, []error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	filters := make([]Filter, len(entries))
+	logs := make([]*AddLog, len(entries))
+	errs := make([]error, len(entries))
+
+	for i, entry := range entries {
+		if f, ok := m.Filters[entry.Name]; ok {
+			filters[i] = f
+			logs[i] = m.logs[entry.Name]
+		} else {
+			errs[i] = fmt.Errorf("filter %s non exists", entry.Name)
+		}
+	}
+
+	return filters, logs, errs
+}
+
+// MultiTest tests keys of each entry against its filter, an unknown filter
+// only fails its own entry
+func (m *FilterManager) MultiTest(entries []MultiEntry) []MultiResult {
+	filters, _, errs := m.getFiltersAndLogs(entries)
+	ret := make([]MultiResult, len(entries))
+
+	for i, entry := range entries {
+		if errs[i] != nil {
+			ret[i].Err = errs[i]
+			continue
+		}
+
+		filter, err := ScopeFilter(filters[i], entry.Scope)
+		if err != nil {
+			ret[i].Err = err
+			continue
+		}
+
+		ret[i].Exists, ret[i].Count = BatchTest(filter, entry.Keys)
+	}
+
+	return ret
+}
+
+// MultiAdd adds keys of each entry to its filter, returns error per entry
+func (m *FilterManager) MultiAdd(entries []MultiEntry) []error {
+	filters, logs, errs := m.getFiltersAndLogs(entries)
+
+	for i, entry := range entries {
+		if errs[i] != nil {
+			continue
+		}
+
+		errs[i] = addKeys(filters[i], logs[i], entry.Keys, !entry.Async)
+	}
+
+	return errs
+}
+
+// TestAndAddKeys adds keys to filter, returns whether they existed in scope
+func (m *FilterManager) TestAndAddKeys(name string, keys []string, scope TestScope) ([]bool, int, error) {
+	filter, l, err := m.getFilterAndLog(name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if filter, err = ScopeFilter(filter, scope); err != nil {
+		return nil, 0, err
+	}
+
+	if l != nil {
+		l.RLock()
+		defer l.RUnlock()
+
+		if err := l.Append(LOG_OP_ADD, keys); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if insertable, ok := filter.(InsertableFilter); ok {
+		return batchTestAndInsert(insertable, keys)
+	}
+
+	ret, exists := BatchTestAndAdd(filter, keys)
+	return ret, exists, nil
+}
+
+func (m *FilterManager) RemoveKeys(name string, keys []string) ([]bool, int, error) {
+	filter, l, err := m.getFilterAndLog(name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	removable, ok := filter.(RemovableFilter)
+	if !ok {
+		return nil, 0, fmt.Errorf("filter %s doesn't support remove", name)
+	}
+
+	if l != nil {
+		l.RLock()
+		defer l.RUnlock()
+
+		if err := l.Append(LOG_OP_REMOVE, keys); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	ret, removed := BatchRemove(removable, keys)
+	return ret, removed, nil
+}
+
+// MergeFilters merges sources into target one by one, then dumps target as
+// merged bits are not in the log. All sources are checked before merging any,
+// so target is never left partially merged
+func (m *FilterManager) MergeFilters(target string, sources []string, op string) error {
+	filter, err := m.GetBloomFilter(target)
+	if err != nil {
+		return err
+	}
+
+	filters := make([]Filter, len(sources))
+	for i, name := range sources {
+		if filters[i], err = m.GetBloomFilter(name); err != nil {
+			return fmt.Errorf("get filter %s error: %v", name, err)
+		}
+
+		if err := checkMerge(filter, filters[i], op); err != nil {
+			return err
+		}
+	}
+
+	for i, source := range filters {
+		if err := MergeFilter(filter, source, op); err != nil {
+			return err
+		}
+		log4go.Info("merged filter %s into %s by %s", sources[i], target, op)
+	}
+
+	if m.persister == nil {
+		return nil
+	}
+	return persistFilter(m.persisterOf(filter), filter)
+}
+
+func (m *FilterManager) DeleteFilter(name string) error {
+	m.deleting.Lock()
+	defer m.deleting.Unlock()
+
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.Filters[name]; !ok {
+		return fmt.Errorf("filter non exists")
+	}
+
+	delete(m.Filters, name)
+	delete(m.logs, name)
+	forgetDumpMetrics(name)
+	log4go.Info("deleted filter %s", name)
+
+	if m.persister != nil {
+		if err := m.persister.Remove(name); err != nil {
+			log4go.Warn("remove persisted files of %s error: %v", name, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// owns returns whether filter is the one of its name in manager
+func (m *FilterManager) owns(filter Filter) bool {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.Filters[filter.Name()] == filter
+}
+
+// persisterOf returns persister for dumps of filter, which fail with
+// FILTER_DELETED_ERROR once filter is deleted from manager
+func (m *FilterManager) persisterOf(filter Filter) FilterPersister {
+	if m.persister == nil {
+		return nil
+	}
+
+	return &managedPersister{FilterPersister: m.persister, m: m, filter: filter}
+}
+
+type managedPersister struct {
+	FilterPersister
+	m      *FilterManager
+	filter Filter
+}
+
+func (p *managedPersister) NewWriter(name string) (Writer, error) {
+	if !p.m.owns(p.filter) {
+		return nil, FILTER_DELETED_ERROR
+	}
+
+	w, err := p.FilterPersister.NewWriter(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &managedWriter{Writer: w, p: p}, nil
+}
+
+type managedWriter struct {
+	Writer
+	p *managedPersister
+}
+
+func (w *managedWriter) Close() error {
+	w.p.m.deleting.RLock()
+	defer w.p.m.deleting.RUnlock()
+
+	if !w.p.m.owns(w.p.filter) {
+		w.Writer.Abort()
+		return FILTER_DELETED_ERROR
+	}
+
+	return w.Writer.Close()
+}
+
+func (w *managedWriter) LogStart() int64 {
+	if logged, ok := w.Writer.(LoggedWriter); ok {
+		return logged.LogStart()
+	}
+
+	return 0
+}
+
+func (w *managedWriter) Hold() error {
+	if logged, ok := w.Writer.(LoggedWriter); ok {
+		return logged.Hold()
+	}
+
+	return nil
+}
+
 func (m *FilterManager) RecoverFilters() error {
 	m.Lock()
 	defer m.Unlock()
@@ -210,17 +714,29 @@ func (m *FilterManager) RecoverFilters() error {
 
 	for _, filterName := range filterNames {
 		reader, closer, err := m.persister.NewReader(filterName)
-		defer closer.Close()
 		if err != nil {
 			log4go.Warn("open filter reader for %s error:%v", filterName, err)
 			continue
 		}
+		defer closer.Close()
 
-		filter, err := loadFilter(reader)
+		filter, header, err := loadFilterWithHeader(reader)
 		if err != nil {
 			log4go.Warn("load filter for %s error:%v", filterName, err)
 			continue
 		}
+		if err := checkName(filterName, filter); err != nil {
+			log4go.Warn("load filter for %s error:%v", filterName, err)
+			continue
+		}
+
+		// keys replayed before the error are kept, the snapshot is still
+		// better than losing the filter
+		if UseWAL {
+			if err := m.replayLog(filterName, filter, header.LogStart); err != nil {
+				log4go.Warn("replay log for %s error:%v", filterName, err)
+			}
+		}
 
 		m.Filters[filterName] = filter
 	}
@@ -228,10 +744,48 @@ func (m *FilterManager) RecoverFilters() error {
 	return nil
 }
 
+// replayLog replays log from start over filter loaded from snapshot
+// this function is not thread safe
+func (m *FilterManager) replayLog(name string, filter Filter, start int64) error {
+	l, err := m.persister.OpenLog(name)
+	if err != nil || l == nil {
+		return err
+	}
+	m.logs[name] = l
+
+	n, err := l.ReplayFrom(start, func(op byte, key []byte) {
+		switch op {
+		case LOG_OP_ADD:
+			filter.Add(key)
+		case LOG_OP_REMOVE:
+			if removable, ok := filter.(RemovableFilter); ok {
+				removable.Remove(key)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	log4go.Info("replayed %d logged keys of %s", n, name)
+	return nil
+}
+
 func (m *FilterManager) Work() {
 	ticker := time.NewTicker(m.forceDumpPeriod)
 	should_stop := false
 
+	stopWorkers := make(chan bool)
+	workersDone := make(chan bool, 2)
+	go func() {
+		m.rotateWork(stopWorkers)
+		workersDone <- true
+	}()
+	go func() {
+		m.infosWork(stopWorkers)
+		workersDone <- true
+	}()
+
 	for {
 		log4go.Info("manager working.., last %v", m.lastForce)
 		force := false
@@ -242,17 +796,24 @@ func (m *FilterManager) Work() {
 			m.lastForce = time.Now()
 		}
 
-		done := make(chan bool, len(m.Filters))
-
+		m.RLock()
+		filters := make([]Filter, 0, len(m.Filters))
 		for _, filter := range m.Filters {
+			filters = append(filters, filter)
+		}
+		m.RUnlock()
+
+		done := make(chan bool, len(filters))
+
+		for _, filter := range filters {
 			go func(force bool, filter Filter) {
-				filter.PeriodMaintaince(m.persister, force)
+				filter.PeriodMaintaince(m.persisterOf(filter), force)
 
 				done <- true
 			}(force, filter)
 		}
 
-		for i := 0; i < len(m.Filters); i++ {
+		for i := 0; i < len(filters); i++ {
 			<-done
 		}
 
@@ -264,14 +825,75 @@ func (m *FilterManager) Work() {
 		case <-m.stop:
 			log4go.Info("got stop signal, exits, dump again")
 			should_stop = true
+			close(stopWorkers)
+			<-workersDone
+			<-workersDone
 		case <-ticker.C:
 		}
 	}
 }
 
+// rotateWork rotates filters once they are due until stop is closed, it's
+// independent of the dump ticker so rotation doesn't lag by force dump period
+func (m *FilterManager) rotateWork(stop chan bool) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+
+		timer.Reset(m.rotateDue(time.Now()))
+	}
+}
+
+// rotateDue dumps and rotates filters due at now, returns how long to wait for
+// the next due one, at most ROTATE_CHECK_PERIOD to pick up new filters
+func (m *FilterManager) rotateDue(now time.Time) time.Duration {
+	m.RLock()
+	filters := make([]*RotatedBloomFilter, 0, len(m.Filters))
+	for _, filter := range m.Filters {
+		if f, ok := filter.(*RotatedBloomFilter); ok {
+			filters = append(filters, f)
+		}
+	}
+	m.RUnlock()
+
+	wait := ROTATE_CHECK_PERIOD
+	for _, f := range filters {
+		next := f.NextRotation()
+		if next.IsZero() {
+			continue
+		}
+
+		if !next.After(now) {
+			// dump before dropping the oldest generation as period rotation
+			// always did, it's retried later if the dump fails
+			if m.persister != nil {
+				if err := persistFilter(m.persisterOf(f), f); err != nil {
+					log4go.Warn("dump filter %s before rotation error: %v", f.Name(), err)
+					continue
+				}
+			}
+
+			f.rotate(now)
+			next = f.NextRotation()
+		}
+
+		if d := next.Sub(now); d < wait {
+			wait = d
+		}
+	}
+
+	return wait
+}
+
 func (m *FilterManager) DumpFilter(name string) error {
 	if filter, ok := m.Filters[name]; ok {
-		return filter.PeriodMaintaince(m.persister, true)
+		return filter.PeriodMaintaince(m.persisterOf(filter), true)
 	} else {
 		return fmt.Errorf("get filter %s error", name)
 	}
@@ -283,22 +905,211 @@ func (m *FilterManager) ReloadFilter(name string, path string) error {
 		if err != nil {
 			return err
 		}
+		defer f.Close()
+
+		log4go.Info("reloading filter %s from %s", name, path)
+		return m.reloadFilter(name, bufio.NewReader(f))
+	} else {
+		return fmt.Errorf("unknown filter name")
+	}
+}
 
-		filter, err := loadFilter(bufio.NewReader(f))
+func (m *FilterManager) ReloadSnapshot(name string, timestamp int64) error {
+	if _, ok := m.Filters[name]; ok {
+		reader, closer, err := m.persister.NewSnapshotReader(name, timestamp)
 		if err != nil {
 			return err
 		}
+		defer closer.Close()
 
-		m.Lock()
-		defer m.Unlock()
-		log4go.Info("reloaded filter %s from %s", name, path)
-		m.Filters[name] = filter
-		return nil
+		log4go.Info("reloading filter %s from snapshot %d", name, timestamp)
+		return m.reloadFilter(name, reader)
 	} else {
 		return fmt.Errorf("unknown filter name")
 	}
 }
 
+func (m *FilterManager) reloadFilter(name string, reader io.Reader) error {
+	filter, err := loadFilter(reader)
+	if err != nil {
+		return err
+	}
+	if err := checkName(name, filter); err != nil {
+		return err
+	}
+
+	m.Lock()
+	log4go.Info("reloaded filter %s", name)
+	m.Filters[name] = filter
+	m.Unlock()
+
+	// the reloaded filter becomes the current snapshot, so log of the
+	// previous one is purged and never replayed over it
+	if m.persister != nil {
+		if err := persistFilter(m.persisterOf(filter), filter); err != nil {
+			log4go.Warn("dump reloaded filter %s error: %v", name, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkName checks that filter loaded for name is named so, dumps of filters
+// are owned by their names
+func checkName(name string, filter Filter) error {
+	if filter.Name() != name {
+		return fmt.Errorf("dump of filter %s can't be loaded as %s", filter.Name(), name)
+	}
+
+	return nil
+}
+
+func (m *FilterManager) ListSnapshots(name string) ([]Snapshot, error) {
+	if _, err := m.GetBloomFilter(name); err != nil {
+		return nil, err
+	}
+
+	return m.persister.ListSnapshots(name)
+}
+
+func (m *FilterManager) GetFilterInfos(name string) ([]FilterInfo, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	if name != "" {
+		f, ok := m.Filters[name]
+		if !ok {
+			return nil, fmt.Errorf("filter non exists")
+		}
+
+		return []FilterInfo{GetFilterInfo(f)}, nil
+	}
+
+	names := make([]string, 0, len(m.Filters))
+	for name := range m.Filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ret := make([]FilterInfo, len(names))
+	for i, name := range names {
+		ret[i] = GetFilterInfo(m.Filters[name])
+	}
+
+	return ret, nil
+}
+
+type cachedInfo struct {
+	filter Filter
+	info   FilterInfo
+}
+
+// infosWork refreshes cached infos every INFOS_REFRESH_PERIOD until stop is closed
+func (m *FilterManager) infosWork(stop chan bool) {
+	ticker := time.NewTicker(INFOS_REFRESH_PERIOD)
+	defer ticker.Stop()
+
+	for {
+		m.refreshInfos()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *FilterManager) refreshInfos() {
+	m.RLock()
+	filters := make([]Filter, 0, len(m.Filters))
+	for _, filter := range m.Filters {
+		filters = append(filters, filter)
+	}
+	m.RUnlock()
+
+	infos := make(map[string]cachedInfo, len(filters))
+	for _, filter := range filters {
+		infos[filter.Name()] = cachedInfo{filter, GetFilterInfo(filter)}
+	}
+
+	m.infosLock.Lock()
+	m.infos = infos
+	m.infosLock.Unlock()
+}
+
+// CachedFilterInfos returns infos of current filters, with cheap fields read
+// now and fill ratios of the last refresh, which are zero for filters created
+// or reloaded since then
+func (m *FilterManager) CachedFilterInfos() []FilterInfo {
+	m.infosLock.RLock()
+	infos := m.infos
+	m.infosLock.RUnlock()
+
+	m.RLock()
+	defer m.RUnlock()
+
+	names := make([]string, 0, len(m.Filters))
+	for name := range m.Filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ret := make([]FilterInfo, len(names))
+	for i, name := range names {
+		f := m.Filters[name]
+		cached, ok := infos[name]
+		if !ok || cached.filter != f {
+			ret[i] = briefInfo(name, f)
+			continue
+		}
+
+		// count of ttl filter is estimated by scanning its buckets
+		count := cached.info.Count
+		if _, ok := f.(*TTLBloomFilter); !ok {
+			count = f.Count()
+		}
+
+		ret[i] = cached.info
+		ret[i].Capacity = f.Capacity()
+		ret[i].Count = count
+		ret[i].Storage = f.Storage()
+	}
+
+	return ret
+}
+
+// ListFilters returns brief info of all filters, without the costly fill ratio
+func (m *FilterManager) ListFilters() []FilterInfo {
+	m.RLock()
+	defer m.RUnlock()
+
+	names := make([]string, 0, len(m.Filters))
+	for name := range m.Filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ret := make([]FilterInfo, len(names))
+	for i, name := range names {
+		ret[i] = briefInfo(name, m.Filters[name])
+	}
+
+	return ret
+}
+
+// briefInfo returns info of f without the costly fill ratios
+func briefInfo(name string, f Filter) FilterInfo {
+	return FilterInfo{
+		Name:     name,
+		Type:     filterType(f),
+		Capacity: f.Capacity(),
+		Count:    f.Count(),
+		Storage:  f.Storage(),
+	}
+}
+
 func (m *FilterManager) Stop() {
 	m.stop <- true
 }
@@ -315,85 +1126,389 @@ func (m *FilterManager) GetBloomFilter(t string) (Filter, error) {
 	return f, nil
 }
 
+func GetFilterInfo(filter Filter) FilterInfo {
+	info := FilterInfo{
+		Name:               filter.Name(),
+		Type:               filterType(filter),
+		Capacity:           filter.Capacity(),
+		K:                  filter.K(),
+		Count:              filter.Count(),
+		ErrorRate:          filter.ErrorRate(),
+		FillRatio:          filter.FillRatio(),
+		EstimatedFillRatio: filter.EstimatedFillRatio(),
+		Storage:            filter.Storage(),
+		Hash:               HashOf(filter),
+	}
+
+	if f, ok := filter.(*RotatedBloomFilter); ok {
+		f.RLock()
+		info.R = f.r
+		info.Current = f.current
+		info.RotateInterval = f.rotateInterval
+		info.LastRotated = f.lastRotated
+		info.NewestOnly = f.newestOnly
+		f.RUnlock()
+		info.NextRotation = f.NextRotation()
+		info.WindowStart = f.WindowStart()
+	}
+
+	if f, ok := filter.(*ScalableBloomFilter); ok {
+		info.Stages = uint(f.Stages())
+	}
+
+	if f, ok := filter.(*TTLBloomFilter); ok {
+		info.TTL = f.TTL()
+	}
+
+	return info
+}
+
+// MergeFilter merges source into target by op, MERGE_UNION or MERGE_INTERSECT
+func MergeFilter(target, source Filter, op string) error {
+	if err := checkMerge(target, source, op); err != nil {
+		return err
+	}
+
+	mergeable := target.(MergeableFilter)
+	switch op {
+	case MERGE_UNION:
+		return mergeable.Union(source)
+	case MERGE_INTERSECT:
+		return mergeable.Intersect(source)
+	default:
+		return fmt.Errorf("unknown merge op: %s", op)
+	}
+}
+
+func checkMerge(target, source Filter, op string) error {
+	mergeable, ok := target.(MergeableFilter)
+	if !ok {
+		return fmt.Errorf("filter %s doesn't support merge", target.Name())
+	}
+
+	if op != MERGE_UNION && op != MERGE_INTERSECT {
+		return fmt.Errorf("unknown merge op: %s", op)
+	}
+
+	return mergeable.CheckMerge(source)
+}
+
+// SubFilters returns generations of rotated filter or stages of scalable
+// filter, nil for other filters
+func SubFilters(filter Filter) []Filter {
+	switch f := filter.(type) {
+	case *RotatedBloomFilter:
+		f.RLock()
+		defer f.RUnlock()
+		return append([]Filter{}, f.innerFilters...)
+	case *ScalableBloomFilter:
+		f.RLock()
+		defer f.RUnlock()
+		return append([]Filter{}, f.stages...)
+	default:
+		return nil
+	}
+}
+
+// EstimatedFalsePositiveRate estimates false positive rate of Test by the
+// real fill ratio of buckets
+func EstimatedFalsePositiveRate(filter Filter) float64 {
+	switch f := filter.(type) {
+	case *RotatedBloomFilter:
+		if !f.newestOnly {
+			f.RLock()
+			defer f.RUnlock()
+			return EstimatedFalsePositiveRate(f.innerFilters[f.current])
+		}
+
+		// keys are tested in all generations
+		negative := 1.0
+		for _, generation := range f.generations() {
+			negative *= 1 - EstimatedFalsePositiveRate(generation)
+		}
+		return 1 - negative
+	case *ScalableBloomFilter:
+		negative := 1.0
+		for _, stage := range SubFilters(f) {
+			negative *= 1 - EstimatedFalsePositiveRate(stage)
+		}
+		return 1 - negative
+	case *CuckooFilter:
+		// a key may match any fingerprint in its two buckets
+		f.RLock()
+		defer f.RUnlock()
+		load := float64(f.count) / float64(f.buckets*CUCKOO_BUCKET_ENTRIES)
+		return math.Min(1, 2*CUCKOO_BUCKET_ENTRIES*load/math.Exp2(float64(f.fpBits)))
+	default:
+		return math.Pow(filter.FillRatio(), float64(filter.K()))
+	}
+}
+
+func filterType(filter Filter) string {
+	switch filter.(type) {
+	case *ClassicBloomFilter:
+		return FILTER_CLASSIC
+	case *RotatedBloomFilter:
+		return FILTER_ROTATED
+	case *CountingBloomFilter:
+		return FILTER_COUNTING
+	case *ScalableBloomFilter:
+		return FILTER_SCALABLE
+	case *BlockedBloomFilter:
+		return FILTER_BLOCKED
+	case *CuckooFilter:
+		return FILTER_CUCKOO
+	case *TTLBloomFilter:
+		return FILTER_TTL
+	default:
+		return ""
+	}
+}
+
 func CheckFilter(reader io.Reader) error {
-	_, err := loadFilter(reader)
+	_, err := CheckDump(reader)
 	return err
 }
 
+// CheckDump loads the whole dump, returns its header even if the body is illegal
+func CheckDump(reader io.Reader) (*DumpHeader, error) {
+	_, header, err := loadFilterWithHeader(reader)
+	return header, err
+}
+
+// WriteDump writes filter to writer in the format the server loads, so
+// filters built offline can be reloaded
+func WriteDump(writer io.Writer, filter Filter) error {
+	return dumpFilter(writer, filter)
+}
+
+// LoadDump loads a dump of any version, for offline inspecting
+func LoadDump(reader io.Reader) (Filter, *DumpHeader, error) {
+	return loadFilterWithHeader(reader)
+}
+
+// ConvertDump loads a dump of any version from reader and writes it to writer
+// in the current format, the header of the source dump is returned
+func ConvertDump(reader io.Reader, writer io.Writer) (*DumpHeader, error) {
+	filter, header, err := loadFilterWithHeader(reader)
+	if err != nil {
+		return header, err
+	}
+
+	return header, dumpFilter(writer, filter)
+}
+
 func loadFilter(reader io.Reader) (Filter, error) {
-	dumpHeader := DumpHeader{}
+	filter, _, err := loadFilterWithHeader(reader)
+	return filter, err
+}
 
-	dec := gob.NewDecoder(reader)
-	if err := dec.Decode(&dumpHeader); err != nil {
-		log4go.Warn("read dump header error : %v", err)
-		return nil, ILLEGAL_LOAD_FORMAT
+func loadFilterWithHeader(reader io.Reader) (Filter, *DumpHeader, error) {
+	br, ok := reader.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(reader)
+	}
+
+	magic, err := br.Peek(len(BINARY_MAGIC))
+	if err != nil || string(magic) != BINARY_MAGIC {
+		return loadLegacyFilter(br)
+	}
+
+	var fixed [8]byte
+	if _, err := io.ReadFull(br, fixed[:]); err != nil {
+		return nil, nil, ILLEGAL_LOAD_FORMAT
+	}
+
+	flags := binary.LittleEndian.Uint16(fixed[6:8])
+	dumpHeader := DumpHeader{
+		Magic:          MAGIC_NUM,
+		Version:        uint(binary.LittleEndian.Uint16(fixed[4:6])),
+		FilterUsedGzip: flags&DUMP_FLAG_GZIP != 0,
 	}
-	if dumpHeader.Magic != MAGIC_NUM {
-		log4go.Warn("mismatch magic number")
-		return nil, ILLEGAL_LOAD_FORMAT
+	if dumpHeader.Version != DUMP_VERSION_BINARY {
+		log4go.Warn("unsupported dump version %d", dumpHeader.Version)
+		return nil, &dumpHeader, ILLEGAL_LOAD_FORMAT
 	}
 	log4go.Trace("loaded header %+v", dumpHeader)
 
+	checksum := newCRCReader(br)
+	var body io.Reader = checksum
+
 	if dumpHeader.FilterUsedGzip {
-		var err error
-		reader, err = gzip.NewReader(reader)
+		gzipReader, err := gzip.NewReader(checksum)
 		if err != nil {
 			log4go.Warn("decompress error: %v", err)
-			return nil, err
+			return nil, &dumpHeader, err
 		}
+		gzipReader.Multistream(false)
+		defer gzipReader.Close()
 
-		reader = bufio.NewReader(reader)
+		body = gzipReader
 	}
 
-	switch dumpHeader.FilterType {
-	case FILTER_CLASSIC:
-		f := &ClassicBloomFilter{}
-		if err := f.Load(reader); err != nil {
-			log4go.Warn("classic fiter load error:%v", err)
-			return nil, err
-		}
+	r := newBinReader(body)
+	if flags&DUMP_FLAG_LOG != 0 {
+		dumpHeader.LogStart = r.I64()
+	}
 
-		return f, nil
-	case FILTER_ROTATED:
-		f := &RotatedBloomFilter{}
-		if err := f.Load(reader); err != nil {
-			return nil, err
+	filter, err := loadSection(r)
+	if err != nil {
+		log4go.Warn("load filter error: %v", err)
+		return nil, &dumpHeader, err
+	}
+	dumpHeader.FilterType = filterType(filter)
+
+	if dumpHeader.FilterUsedGzip {
+		// reach the end of gzip stream, so its trailer is verified
+		if _, err := io.Copy(ioutil.Discard, body); err != nil {
+			log4go.Warn("decompress error: %v", err)
+			return nil, &dumpHeader, err
 		}
+	}
 
-		return f, nil
-	default:
-		log4go.Warn("unknown filter type :%v", dumpHeader.FilterType)
-		return nil, ILLEGAL_LOAD_FORMAT
+	var sum [4]byte
+	if _, err := io.ReadFull(br, sum[:]); err != nil {
+		log4go.Warn("read checksum of %s error: %v", filter.Name(), err)
+		return nil, &dumpHeader, ILLEGAL_LOAD_FORMAT
 	}
+	if binary.LittleEndian.Uint32(sum[:]) != checksum.crc.Sum32() {
+		log4go.Warn("verify %s filter %s error: %v", dumpHeader.FilterType, filter.Name(), CHECKSUM_ERROR)
+		return nil, &dumpHeader, CHECKSUM_ERROR
+	}
+
+	return filter, &dumpHeader, nil
 }
 
 func dumpFilter(writer io.Writer, filter Filter) error {
-	dumpHeader := DumpHeader{
-		Magic:          MAGIC_NUM,
-		FilterUsedGzip: UseGzip,
-	}
+	return dumpFilterLogged(writer, filter, 0)
+}
 
-	switch filter.(type) {
-	case *ClassicBloomFilter:
-		dumpHeader.FilterType = FILTER_CLASSIC
-	case *RotatedBloomFilter:
-		dumpHeader.FilterType = FILTER_ROTATED
-	default:
+// dumpFilterLogged dumps filter which has keys of add log before logStart
+func dumpFilterLogged(writer io.Writer, filter Filter, logStart int64) error {
+	if filterType(filter) == "" {
 		panic("what the fuck type")
 	}
 
-	enc := gob.NewEncoder(writer)
-	if err := enc.Encode(&dumpHeader); err != nil {
+	flags := uint16(0)
+	if UseGzip {
+		flags |= DUMP_FLAG_GZIP
+	}
+	if logStart > 0 {
+		flags |= DUMP_FLAG_LOG
+	}
+
+	var fixed [8]byte
+	copy(fixed[:4], BINARY_MAGIC)
+	binary.LittleEndian.PutUint16(fixed[4:6], DUMP_VERSION_BINARY)
+	binary.LittleEndian.PutUint16(fixed[6:8], flags)
+
+	if _, err := writer.Write(fixed[:]); err != nil {
 		log4go.Warn("encode header error: %v", err)
 		return DUMP_ERROR
 	}
 
+	checksum := &crcWriter{w: writer, crc: crc32.NewIEEE()}
+
 	if UseGzip {
-		gwriter := gzip.NewWriter(writer)
-		defer gwriter.Close()
+		gwriter := gzip.NewWriter(checksum)
+		if err := dumpBody(newBinWriter(gwriter), filter, logStart); err != nil {
+			gwriter.Close()
+			return err
+		}
 
-		return filter.Dump(gwriter)
+		if err := gwriter.Close(); err != nil {
+			return err
+		}
 	} else {
-		return filter.Dump(writer)
+		if err := dumpBody(newBinWriter(checksum), filter, logStart); err != nil {
+			return err
+		}
 	}
+
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], checksum.crc.Sum32())
+	_, err := writer.Write(sum[:])
+	return err
+}
+
+func dumpBody(w *binWriter, filter Filter, logStart int64) error {
+	if logStart > 0 {
+		w.I64(logStart)
+	}
+
+	return dumpSection(w, filter)
+}
+
+var (
+	dumpDuration = metrics.NewHistogramVec("bfserver_dump_duration_seconds",
+		"duration of filter dumps to snapshots", metrics.ExponentialBuckets(0.001, 4, 10), "filter")
+	dumpSize = metrics.NewGaugeVec("bfserver_dump_size_bytes",
+		"size of the last successful dump of filter", "filter")
+	dumpFailures = metrics.NewCounterVec("bfserver_dump_failures_total",
+		"failed filter dumps", "filter")
+)
+
+// forgetDumpMetrics drops dump metrics of a deleted filter
+func forgetDumpMetrics(name string) {
+	dumpDuration.Delete(name)
+	dumpSize.Delete(name)
+	dumpFailures.Delete(name)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// persistFilter dumps filter to a new snapshot, the snapshot is dropped if
+// dump failed so the last good one is kept
+func persistFilter(persister FilterPersister, filter Filter) error {
+	start := time.Now()
+	defer func() {
+		dumpDuration.Observe(time.Since(start).Seconds(), filter.Name())
+	}()
+
+	writer, err := persister.NewWriter(filter.Name())
+	if err != nil {
+		log4go.Warn("create writer error:%v", err)
+		dumpFailures.Inc(filter.Name())
+		return err
+	}
+
+	logStart := int64(0)
+	if logged, ok := writer.(LoggedWriter); ok {
+		// adds of removable filters aren't idempotent, keys in snapshot
+		// mustn't be replayed again
+		if _, ok := filter.(RemovableFilter); ok {
+			if err := logged.Hold(); err != nil {
+				dumpFailures.Inc(filter.Name())
+				writer.Abort()
+				return err
+			}
+		}
+		logStart = logged.LogStart()
+	}
+
+	counter := &countingWriter{w: writer}
+	if err = dumpFilterLogged(counter, filter, logStart); err != nil {
+		log4go.Warn("dumpfilter error:%v", err)
+		dumpFailures.Inc(filter.Name())
+		writer.Abort()
+		return err
+	}
+
+	if err = writer.Close(); err != nil {
+		log4go.Warn("close writer error:%v", err)
+		dumpFailures.Inc(filter.Name())
+		return err
+	}
+
+	dumpSize.Set(float64(counter.n), filter.Name())
+	return nil
 }
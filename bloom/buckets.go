@@ -1,9 +1,9 @@
 package bloom
 
 import (
-	"encoding/gob"
 	"github.com/alecthomas/log4go"
 	"io"
+	"math"
 )
 
 type Buckets struct {
@@ -13,13 +13,6 @@ type Buckets struct {
 	count      uint
 }
 
-type BucketsDump struct {
-	Data  []byte
-	Max   uint8
-	Size  uint8
-	Count uint
-}
-
 func NewBuckets(count uint, bucketSize uint8) *Buckets {
 	return &Buckets{
 		count:      count,
@@ -37,6 +30,10 @@ func (b *Buckets) Count() uint {
 	return b.count
 }
 
+func (b *Buckets) Storage() uint64 {
+	return uint64(len(b.data))
+}
+
 func (b *Buckets) Increment(bucket uint, delta int32) *Buckets {
 	val := int32(b.getBits(bucket*uint(b.bucketSize), uint(b.bucketSize))) + delta
 
@@ -60,6 +57,13 @@ func (b *Buckets) Set(bucket uint, value uint8) *Buckets {
 	return b
 }
 
+// SetValue sets bucket to value of up to 32 bits, bits above the bucket size
+// are dropped
+func (b *Buckets) SetValue(bucket uint, value uint32) *Buckets {
+	b.setBits(uint32(bucket)*uint32(b.bucketSize), uint32(b.bucketSize), value)
+	return b
+}
+
 func (b *Buckets) Get(bucket uint) uint32 {
 	return b.getBits(bucket*uint(b.bucketSize), uint(b.bucketSize))
 }
@@ -103,29 +107,62 @@ func (b *Buckets) i_set_bits(offset, length, bits uint32) {
 }
 
 func (b *Buckets) Dump(stream io.Writer) error {
-	enc := gob.NewEncoder(stream)
-	d := BucketsDump{
-		Max:   b.max,
-		Data:  b.data,
-		Count: b.count,
-		Size:  b.bucketSize,
-	}
+	w := newBinWriter(stream)
 
-	return enc.Encode(&d)
+	writeBucketsHeader(w, uint32(b.bucketSize), uint64(b.count), uint64(len(b.data)))
+	w.Write(b.data)
+	w.Pad(8)
+
+	return w.err
 }
 
 func (b *Buckets) Load(stream io.Reader) error {
-	d := &BucketsDump{}
-	dec := gob.NewDecoder(stream)
-	if err := dec.Decode(d); err != nil {
-		log4go.Info("load bucket error: %+v", err)
+	r := newBinReader(stream)
+
+	size, count, length, err := readBucketsHeader(r)
+	if err != nil {
 		return err
 	}
 
-	b.max = d.Max
-	b.data = d.Data
-	b.bucketSize = d.Size
-	b.count = d.Count
+	data := r.Bytes(length)
+	r.Pad(8)
+	if r.err != nil {
+		log4go.Info("load bucket error: %+v", r.err)
+		return r.err
+	}
+
+	b.bucketSize = uint8(size)
+	b.max = uint8((1 << size) - 1)
+	b.count = uint(count)
+	b.data = data
 
 	return nil
 }
+
+// writeBucketsHeader writes header of buckets, raw data and padding follow
+func writeBucketsHeader(w *binWriter, size uint32, count, length uint64) {
+	w.Pad(8)
+	w.U32(size)
+	w.U32(0)
+	w.U64(count)
+	w.U64(length)
+}
+
+func readBucketsHeader(r *binReader) (uint32, uint64, uint64, error) {
+	r.Pad(8)
+	size := r.U32()
+	r.U32()
+	count := r.U64()
+	length := r.U64()
+	if r.err != nil {
+		log4go.Info("load bucket error: %+v", r.err)
+		return 0, 0, 0, r.err
+	}
+
+	if size == 0 || size > 32 || count > math.MaxUint64/32 || length != (count*uint64(size)+7)/8 {
+		log4go.Warn("illegal buckets, size:%d count:%d length:%d", size, count, length)
+		return 0, 0, 0, ILLEGAL_LOAD_FORMAT
+	}
+
+	return size, count, length, nil
+}
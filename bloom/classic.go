@@ -1,31 +1,28 @@
 package bloom
 
 import (
-	"encoding/gob"
 	"fmt"
 	"io"
 	"math"
 	"sync"
+	"sync/atomic"
 
 	"github.com/alecthomas/log4go"
 )
 
+// ClassicBloomFilter adds and tests keys without locks on an atomic bitset,
+// only TestAndAdd is serialized so one of concurrent same keys sees it exists
 type ClassicBloomFilter struct {
-	sync.RWMutex
+	mu sync.Mutex // serializes TestAndAdd
 
-	name  string
-	m     uint // filter size
-	k     uint // number of hash functions
-	count uint // number of items added
+	name      string
+	m         uint    // filter size
+	k         uint    // number of hash functions
+	count     uint64  // number of items added, accessed atomically
+	errorRate float64 // configured false positive rate
+	hash      byte    // kind of hash function
 
-	buckets *Buckets // filter data
-}
-
-type ClassicBloomFilterDumpHeader struct {
-	Name  string
-	M     uint
-	K     uint
-	Count uint
+	bits *Bitset // filter data
 }
 
 func NewClassicBloomFilter(options FilterOptions) (Filter, error) {
@@ -33,13 +30,20 @@ func NewClassicBloomFilter(options FilterOptions) (Filter, error) {
 		return nil, fmt.Errorf("illegal params")
 	}
 
+	hash, err := hashKindOf(options.Hash)
+	if err != nil {
+		return nil, err
+	}
+
 	m := OptimalM(options.N, options.ErrorRate)
 
 	return &ClassicBloomFilter{
-		name:    options.Name,
-		buckets: NewBuckets(m, 1),
-		m:       m,
-		k:       OptimalK(options.ErrorRate),
+		name:      options.Name,
+		bits:      NewBitset(m),
+		m:         m,
+		k:         OptimalK(options.ErrorRate),
+		errorRate: options.ErrorRate,
+		hash:      hash,
 	}, nil
 }
 
@@ -55,48 +59,39 @@ func (b *ClassicBloomFilter) K() uint {
 }
 
 func (b *ClassicBloomFilter) Count() uint {
-	return b.count
+	return uint(atomic.LoadUint64(&b.count))
+}
+
+func (b *ClassicBloomFilter) ErrorRate() float64 {
+	return b.errorRate
+}
+
+func (b *ClassicBloomFilter) Storage() uint64 {
+	return b.bits.Storage()
 }
 
 func (b *ClassicBloomFilter) EstimatedFillRatio() float64 {
-	return 1 - math.Exp((-float64(b.count)*float64(b.k))/float64(b.m))
+	return 1 - math.Exp((-float64(b.Count())*float64(b.k))/float64(b.m))
 }
 
 func (b *ClassicBloomFilter) PeriodMaintaince(persister FilterPersister, force bool) error {
 	if force {
-		writer, err := persister.NewWriter(b.name)
-		defer writer.Close()
-
 		log4go.Info("period dump classic bloom filter: %s", b.name)
-		if err != nil {
-			log4go.Warn("create writer error:%v", err)
-			return err
-		}
-		if err = dumpFilter(writer, b); err != nil {
-			log4go.Warn("dumpfilter error:%v", err)
-			return err
-		}
+		return persistFilter(persister, b)
 	}
 
 	return nil
 }
 
 func (b *ClassicBloomFilter) FillRatio() float64 {
-	sum := uint32(0)
-	for i := uint(0); i < b.buckets.Count(); i++ {
-		sum += b.buckets.Get(i)
-	}
-	return float64(sum) / float64(b.m)
+	return float64(b.bits.ones()) / float64(b.m)
 }
 
 func (b *ClassicBloomFilter) Test(data []byte) bool {
-	b.RLock()
-	defer b.RUnlock()
-
-	lower, upper := hashKernel(data)
+	h1, h2 := hashKeys(b.hash, data)
 
 	for i := uint(0); i < b.k; i++ {
-		if b.buckets.Get((uint(lower)+uint(upper)*i)%b.m) == 0 {
+		if !b.bits.Get(location(h1, h2, i, b.m)) {
 			return false
 		}
 	}
@@ -105,61 +100,140 @@ func (b *ClassicBloomFilter) Test(data []byte) bool {
 }
 
 func (b *ClassicBloomFilter) Add(data []byte) Filter {
-	b.Lock()
-	defer b.Unlock()
+	b.add(data)
+	atomic.AddUint64(&b.count, 1)
+	return b
+}
 
-	lower, upper := hashKernel(data)
+// add sets bits of key, returns whether all of them were set before
+func (b *ClassicBloomFilter) add(data []byte) bool {
+	h1, h2 := hashKeys(b.hash, data)
+	exists := true
 
 	for i := uint(0); i < b.k; i++ {
-		b.buckets.Set((uint(lower)+uint(upper)*i)%b.m, 1)
+		if !b.bits.Set(location(h1, h2, i, b.m)) {
+			exists = false
+		}
 	}
 
-	b.count++
-	return b
+	return exists
 }
 
-func (b *ClassicBloomFilter) Reset() {
-	b.Lock()
-	defer b.Unlock()
+func (b *ClassicBloomFilter) TestAndAdd(data []byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	b.buckets.Reset()
+	exists := b.add(data)
+	if !exists {
+		atomic.AddUint64(&b.count, 1)
+	}
+
+	return exists
 }
 
-func (b *ClassicBloomFilter) Load(stream io.Reader) error {
-	dec := gob.NewDecoder(stream)
-	header := ClassicBloomFilterDumpHeader{}
-	err := dec.Decode(&header)
-	if err != nil {
-		log4go.Warn("read class bloom filter header error")
+func (b *ClassicBloomFilter) Union(other Filter) error {
+	return b.merge(other, (*Bitset).union)
+}
+
+func (b *ClassicBloomFilter) Intersect(other Filter) error {
+	return b.merge(other, (*Bitset).intersect)
+}
+
+func (b *ClassicBloomFilter) CheckMerge(other Filter) error {
+	o, ok := other.(*ClassicBloomFilter)
+	if !ok {
+		return fmt.Errorf("can't merge %s filter into classic filter", filterType(other))
+	}
+
+	if o.m != b.m || o.k != b.k || o.hash != b.hash {
+		return fmt.Errorf("can't merge filter of m:%d k:%d hash:%s into m:%d k:%d hash:%s",
+			o.m, o.k, hashName(o.hash), b.m, b.k, hashName(b.hash))
+	}
+
+	return nil
+}
+
+func (b *ClassicBloomFilter) merge(other Filter, op func(*Bitset, *Bitset)) error {
+	if err := b.CheckMerge(other); err != nil {
 		return err
 	}
 
-	b.name = header.Name
-	b.k = header.K
-	b.m = header.M
-	b.count = header.Count
-	b.buckets = NewBuckets(b.m, 1)
-	log4go.Info("loaded classic filter name:%s k:%d m:%d count:%d", b.name, b.k, b.m, b.count)
+	o := other.(*ClassicBloomFilter)
+	if o == b {
+		return nil
+	}
+
+	op(b.bits, o.bits)
+	atomic.StoreUint64(&b.count, uint64(b.estimateCount()))
 
-	return b.buckets.Load(stream)
+	return nil
 }
 
-func (b *ClassicBloomFilter) Dump(stream io.Writer) error {
-	enc := gob.NewEncoder(stream)
+// estimateCount estimates keys count by bits set, as the exact count is
+// unknown after merging
+func (b *ClassicBloomFilter) estimateCount() uint {
+	ones := b.bits.ones()
+	if ones >= b.m {
+		ones = b.m - 1
+	}
 
-	header := ClassicBloomFilterDumpHeader{
-		Name:  b.name,
-		K:     b.k,
-		M:     b.m,
-		Count: b.count,
+	return uint(math.Ceil(-float64(b.m) / float64(b.k) * math.Log(1-float64(ones)/float64(b.m))))
+}
+
+func (b *ClassicBloomFilter) Reset() {
+	b.bits.Reset()
+	atomic.StoreUint64(&b.count, 0)
+}
+
+func (b *ClassicBloomFilter) Load(stream io.Reader) error {
+	r := newBinReader(stream)
+	t, meta := r.Section()
+	if r.err != nil || t != SECTION_CLASSIC {
+		log4go.Warn("read class bloom filter header error")
+		return ILLEGAL_LOAD_FORMAT
 	}
 
-	err := enc.Encode(&header)
-	if err != nil {
-		log4go.Warn("encode error: %v", err)
+	b.name = meta.String()
+	b.m = uint(meta.U64())
+	b.k = uint(meta.U32())
+	b.count = meta.U64()
+	b.errorRate = meta.F64()
+	b.hash = meta.U8()
+	if hashName(b.hash) == "" {
+		log4go.Warn("unknown hash kind %d", b.hash)
+		return ILLEGAL_LOAD_FORMAT
+	}
+	b.bits = &Bitset{}
+	log4go.Info("loaded classic filter name:%s k:%d m:%d count:%d", b.name, b.k, b.m, b.count)
+
+	if err := b.bits.Load(r); err != nil {
 		return err
 	}
-	log4go.Info("dumped filter header with name:%s k:%d m:%d count:%d", b.name, b.k, b.m, b.count)
+	if b.bits.Count() != b.m || b.m == 0 {
+		log4go.Warn("bitset count %d mismatch m %d", b.bits.Count(), b.m)
+		return ILLEGAL_LOAD_FORMAT
+	}
+
+	return nil
+}
+
+func (b *ClassicBloomFilter) Dump(stream io.Writer) error {
+	w := newBinWriter(stream)
+
+	count := b.Count()
+	w.Section(SECTION_CLASSIC, func(meta *binWriter) {
+		meta.String(b.name)
+		meta.U64(uint64(b.m))
+		meta.U32(uint32(b.k))
+		meta.U64(uint64(count))
+		meta.F64(b.errorRate)
+		meta.U8(b.hash)
+	})
+	if w.err != nil {
+		log4go.Warn("encode error: %v", w.err)
+		return w.err
+	}
+	log4go.Info("dumped filter header with name:%s k:%d m:%d count:%d", b.name, b.k, b.m, count)
 
-	return b.buckets.Dump(stream)
+	return b.bits.Dump(w)
 }
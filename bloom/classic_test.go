@@ -2,7 +2,9 @@ package bloom
 
 import (
 	"bytes"
+	"encoding/binary"
 	"strconv"
+	"sync"
 	"testing"
 )
 
@@ -14,12 +16,26 @@ func bucketsEqual(a, b *Buckets) bool {
 	return true
 }
 
+func bitsetEqual(a, b *Bitset) bool {
+	if a.count != b.count || len(a.words) != len(b.words) {
+		return false
+	}
+
+	for i := range a.words {
+		if a.words[i] != b.words[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
 func classicBloomFilterEqual(a, b *ClassicBloomFilter) bool {
-	if a.name != b.name || a.m != b.m || a.k != b.k || a.count != b.count {
+	if a.name != b.name || a.m != b.m || a.k != b.k || a.count != b.count || a.errorRate != b.errorRate {
 		return false
 	}
 
-	return bucketsEqual(a.buckets, b.buckets)
+	return bitsetEqual(a.bits, b.bits)
 }
 
 // Ensures that Capacity returns the number of bits, m, in the Bloom filter.
@@ -52,6 +68,24 @@ func TestBloomCount(t *testing.T) {
 	}
 }
 
+// Ensures that ErrorRate returns the configured error rate.
+func TestBloomErrorRate(t *testing.T) {
+	f, _ := NewClassicBloomFilter(FilterOptions{N: 100, ErrorRate: 0.1})
+
+	if rate := f.ErrorRate(); rate != 0.1 {
+		t.Errorf("Expected 0.1, got %f", rate)
+	}
+}
+
+// Ensures that Storage returns the bytes used by the word aligned bitset.
+func TestBloomStorage(t *testing.T) {
+	f, _ := NewClassicBloomFilter(FilterOptions{N: 100, ErrorRate: 0.1})
+
+	if storage := f.Storage(); storage != 64 {
+		t.Errorf("Expected 64, got %d", storage)
+	}
+}
+
 // Ensures that EstimatedFillRatio returns the correct approximation.
 func TestBloomEstimatedFillRatio(t *testing.T) {
 	f, _ := NewClassicBloomFilter(FilterOptions{N: 100, ErrorRate: 0.5})
@@ -100,6 +134,27 @@ func TestBloomTestAndAdd(t *testing.T) {
 	}
 }
 
+// Ensures that TestAndAdd returns the membership before adding.
+func TestBloomTestAndAddFlag(t *testing.T) {
+	f, _ := NewClassicBloomFilter(FilterOptions{N: 100, ErrorRate: 0.01})
+
+	if f.TestAndAdd([]byte(`a`)) {
+		t.Error("`a` should not be a member")
+	}
+
+	if !f.Test([]byte(`a`)) {
+		t.Error("`a` should be a member")
+	}
+
+	if !f.TestAndAdd([]byte(`a`)) {
+		t.Error("`a` should be a member")
+	}
+
+	if count := f.Count(); count != 1 {
+		t.Errorf("Expected 1, got %d", count)
+	}
+}
+
 // Ensures that Reset sets every bit to zero.
 func TestBloomReset(t *testing.T) {
 	fs, _ := NewClassicBloomFilter(FilterOptions{N: 100, ErrorRate: 0.1})
@@ -110,8 +165,8 @@ func TestBloomReset(t *testing.T) {
 
 	f.Reset()
 
-	for i := uint(0); i < f.buckets.Count(); i++ {
-		if f.buckets.Get(i) != 0 {
+	for i := uint(0); i < f.bits.Count(); i++ {
+		if f.bits.Get(i) {
 			t.Error("Expected all bits to be unset")
 		}
 	}
@@ -144,3 +199,121 @@ func BenchmarkBloomTest(b *testing.B) {
 		f.Test(data[n])
 	}
 }
+
+// Ensures that estimated false positive rate follows the fill ratio.
+func TestEstimatedFalsePositiveRate(t *testing.T) {
+	f, _ := NewClassicBloomFilter(FilterOptions{Name: "test", ErrorRate: 0.01, N: 1000})
+	if rate := EstimatedFalsePositiveRate(f); rate != 0 {
+		t.Errorf("empty filter fp rate should be 0, got %v", rate)
+	}
+
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	if rate := EstimatedFalsePositiveRate(f); rate <= 0.001 || rate >= 0.05 {
+		t.Errorf("full filter fp rate should be near 0.01, got %v", rate)
+	}
+
+	if SubFilters(f) != nil {
+		t.Errorf("classic filter has no sub filters")
+	}
+}
+
+// Ensures that union and intersect of classic filters keep keys of both or common ones.
+func TestBloomUnionIntersect(t *testing.T) {
+	options := FilterOptions{Name: "test", ErrorRate: 0.001, N: 1000}
+	a, _ := NewClassicBloomFilter(options)
+	b, _ := NewClassicBloomFilter(options)
+	for i := 0; i < 200; i++ {
+		a.Add([]byte(strconv.Itoa(i)))
+		b.Add([]byte(strconv.Itoa(i + 100)))
+	}
+
+	union, _ := NewClassicBloomFilter(options)
+	MergeFilter(union, a, MERGE_UNION)
+	if err := MergeFilter(union, b, MERGE_UNION); err != nil {
+		t.Errorf("union error: %v", err)
+		return
+	}
+	for i := 0; i < 300; i++ {
+		if !union.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("key %d should be in union", i)
+		}
+	}
+	if union.Count() < 280 || union.Count() > 320 {
+		t.Errorf("estimated count of union should be near 300, got %d", union.Count())
+	}
+
+	if err := MergeFilter(a, b, MERGE_INTERSECT); err != nil {
+		t.Errorf("intersect error: %v", err)
+		return
+	}
+	for i := 100; i < 200; i++ {
+		if !a.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("key %d should be in intersection", i)
+		}
+	}
+	if a.Test([]byte("1")) || a.Test([]byte("250")) {
+		t.Errorf("keys of one side should not be in intersection")
+	}
+
+	other, _ := NewClassicBloomFilter(FilterOptions{Name: "test", ErrorRate: 0.01, N: 1000})
+	if err := MergeFilter(a, other, MERGE_UNION); err == nil {
+		t.Errorf("merge filters of different m should fail")
+	}
+}
+
+// bitsetBytes returns bitset as data of 1-bit buckets
+func bitsetBytes(b *Bitset) []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.LittleEndian, b.words)
+	return buffer.Bytes()[:(b.count+7)/8]
+}
+
+// Ensures that bitset keeps the bit layout of 1-bit buckets.
+func TestBitsetBucketsLayout(t *testing.T) {
+	bits := NewBitset(1000)
+	buckets := NewBuckets(1000, 1)
+	for _, i := range []uint{0, 7, 8, 63, 64, 500, 999} {
+		bits.Set(i)
+		buckets.Set(i, 1)
+	}
+
+	if !bytes.Equal(bitsetBytes(bits), buckets.data) {
+		t.Errorf("bitset layout differs from buckets")
+	}
+
+	if !bitsetEqual(newBitsetOfBytes(1000, buckets.data), bits) {
+		t.Errorf("bitset of buckets data error")
+	}
+
+	if bits.Set(500) != true || bits.Set(501) != false || !bits.Get(501) {
+		t.Errorf("set should return whether bit was set")
+	}
+}
+
+// Ensures that concurrent Add and Test need no locks.
+func TestBloomConcurrentAddTest(t *testing.T) {
+	f, _ := NewClassicBloomFilter(FilterOptions{Name: "test", ErrorRate: 0.01, N: 10000})
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := []byte(strconv.Itoa(g*1000 + i))
+				f.Add(key)
+				if !f.Test(key) {
+					t.Errorf("key %s should exist after add", key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if f.Count() != 8000 {
+		t.Errorf("expected count 8000, got %d", f.Count())
+	}
+}
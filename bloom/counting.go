@@ -0,0 +1,239 @@
+package bloom
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/alecthomas/log4go"
+)
+
+const (
+	COUNTING_BUCKET_SIZE = 4
+)
+
+type CountingBloomFilter struct {
+	sync.RWMutex
+
+	name       string
+	m          uint    // filter size
+	k          uint    // number of hash functions
+	count      uint    // number of items added
+	errorRate  float64 // configured false positive rate
+	bucketSize uint8   // bits of each counter
+	hash       byte    // kind of hash function
+
+	buckets *Buckets // filter data
+}
+
+func NewCountingBloomFilter(options FilterOptions) (Filter, error) {
+	if options.ErrorRate == 0 || options.N == 0 {
+		return nil, fmt.Errorf("illegal params")
+	}
+
+	hash, err := hashKindOf(options.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	m := OptimalM(options.N, options.ErrorRate)
+
+	return &CountingBloomFilter{
+		name:       options.Name,
+		buckets:    NewBuckets(m, COUNTING_BUCKET_SIZE),
+		m:          m,
+		k:          OptimalK(options.ErrorRate),
+		errorRate:  options.ErrorRate,
+		bucketSize: COUNTING_BUCKET_SIZE,
+		hash:       hash,
+	}, nil
+}
+
+func (b *CountingBloomFilter) Name() string {
+	return b.name
+}
+
+func (b *CountingBloomFilter) Capacity() uint {
+	return b.m
+}
+
+func (b *CountingBloomFilter) K() uint {
+	return b.k
+}
+
+func (b *CountingBloomFilter) Count() uint {
+	return b.count
+}
+
+func (b *CountingBloomFilter) ErrorRate() float64 {
+	return b.errorRate
+}
+
+func (b *CountingBloomFilter) Storage() uint64 {
+	return b.buckets.Storage()
+}
+
+func (b *CountingBloomFilter) EstimatedFillRatio() float64 {
+	return 1 - math.Exp((-float64(b.count)*float64(b.k))/float64(b.m))
+}
+
+func (b *CountingBloomFilter) FillRatio() float64 {
+	b.RLock()
+	defer b.RUnlock()
+
+	sum := uint(0)
+	for i := uint(0); i < b.buckets.Count(); i++ {
+		if b.buckets.Get(i) > 0 {
+			sum++
+		}
+	}
+	return float64(sum) / float64(b.m)
+}
+
+func (b *CountingBloomFilter) PeriodMaintaince(persister FilterPersister, force bool) error {
+	if force {
+		log4go.Info("period dump counting bloom filter: %s", b.name)
+		return persistFilter(persister, b)
+	}
+
+	return nil
+}
+
+func (b *CountingBloomFilter) Test(data []byte) bool {
+	b.RLock()
+	defer b.RUnlock()
+
+	return b.test(data)
+}
+
+func (b *CountingBloomFilter) test(data []byte) bool {
+	h1, h2 := hashKeys(b.hash, data)
+
+	for i := uint(0); i < b.k; i++ {
+		if b.buckets.Get(location(h1, h2, i, b.m)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (b *CountingBloomFilter) Add(data []byte) Filter {
+	b.Lock()
+	defer b.Unlock()
+
+	h1, h2 := hashKeys(b.hash, data)
+
+	for i := uint(0); i < b.k; i++ {
+		b.buckets.Increment(location(h1, h2, i, b.m), 1)
+	}
+
+	b.count++
+	return b
+}
+
+func (b *CountingBloomFilter) TestAndAdd(data []byte) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.test(data) {
+		return true
+	}
+
+	h1, h2 := hashKeys(b.hash, data)
+
+	for i := uint(0); i < b.k; i++ {
+		b.buckets.Increment(location(h1, h2, i, b.m), 1)
+	}
+
+	b.count++
+	return false
+}
+
+// Remove decrements the counters of data, returns false if data is not a member.
+// saturated counters are never decremented, or other keys may be lost
+func (b *CountingBloomFilter) Remove(data []byte) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if !b.test(data) {
+		return false
+	}
+
+	h1, h2 := hashKeys(b.hash, data)
+	max := uint32(b.buckets.MaxBucketValue())
+
+	for i := uint(0); i < b.k; i++ {
+		bucket := location(h1, h2, i, b.m)
+		if b.buckets.Get(bucket) < max {
+			b.buckets.Increment(bucket, -1)
+		}
+	}
+
+	if b.count > 0 {
+		b.count--
+	}
+	return true
+}
+
+func (b *CountingBloomFilter) Reset() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.buckets.Reset()
+	b.count = 0
+}
+
+func (b *CountingBloomFilter) Load(stream io.Reader) error {
+	r := newBinReader(stream)
+	t, meta := r.Section()
+	if r.err != nil || t != SECTION_COUNTING {
+		log4go.Warn("read counting bloom filter header error")
+		return ILLEGAL_LOAD_FORMAT
+	}
+
+	b.name = meta.String()
+	b.m = uint(meta.U64())
+	b.k = uint(meta.U32())
+	b.count = uint(meta.U64())
+	b.errorRate = meta.F64()
+	b.hash = meta.U8()
+	if hashName(b.hash) == "" {
+		log4go.Warn("unknown hash kind %d", b.hash)
+		return ILLEGAL_LOAD_FORMAT
+	}
+	b.buckets = &Buckets{}
+	log4go.Info("loaded counting filter name:%s k:%d m:%d count:%d", b.name, b.k, b.m, b.count)
+
+	if err := b.buckets.Load(r); err != nil {
+		return err
+	}
+	if b.buckets.Count() != b.m || b.m == 0 {
+		log4go.Warn("buckets count %d mismatch m %d", b.buckets.Count(), b.m)
+		return ILLEGAL_LOAD_FORMAT
+	}
+	b.bucketSize = b.buckets.bucketSize
+
+	return nil
+}
+
+func (b *CountingBloomFilter) Dump(stream io.Writer) error {
+	w := newBinWriter(stream)
+
+	w.Section(SECTION_COUNTING, func(meta *binWriter) {
+		meta.String(b.name)
+		meta.U64(uint64(b.m))
+		meta.U32(uint32(b.k))
+		meta.U64(uint64(b.count))
+		meta.F64(b.errorRate)
+		meta.U8(b.hash)
+	})
+	if w.err != nil {
+		log4go.Warn("encode error: %v", w.err)
+		return w.err
+	}
+	log4go.Info("dumped counting filter header with name:%s k:%d m:%d count:%d", b.name, b.k, b.m, b.count)
+
+	return b.buckets.Dump(w)
+}
@@ -0,0 +1,95 @@
+package bloom
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+// Ensures that the counters of counting filter use multiple bits.
+func TestCountingBloomCapacity(t *testing.T) {
+	f, _ := NewCountingBloomFilter(FilterOptions{N: 100, ErrorRate: 0.1})
+
+	if capacity := f.Capacity(); capacity != 480 {
+		t.Errorf("Expected 480, got %d", capacity)
+	}
+
+	if storage := f.Storage(); storage != 240 {
+		t.Errorf("Expected 240, got %d", storage)
+	}
+}
+
+// Ensures that Test, Add and Remove behave correctly.
+func TestCountingBloomRemove(t *testing.T) {
+	fs, _ := NewCountingBloomFilter(FilterOptions{N: 100, ErrorRate: 0.01})
+	f := fs.(*CountingBloomFilter)
+
+	if f.Remove([]byte(`a`)) {
+		t.Error("`a` should not be removed")
+	}
+
+	f.Add([]byte(`a`))
+	f.Add([]byte(`b`))
+	f.Add([]byte(`b`))
+
+	if !f.Test([]byte(`a`)) || !f.Test([]byte(`b`)) {
+		t.Error("`a` and `b` should be members")
+	}
+
+	if !f.Remove([]byte(`a`)) {
+		t.Error("`a` should be removed")
+	}
+
+	if f.Test([]byte(`a`)) {
+		t.Error("`a` should not be a member")
+	}
+
+	if !f.Remove([]byte(`b`)) || !f.Test([]byte(`b`)) {
+		t.Error("`b` was added twice, should still be a member")
+	}
+
+	if count := f.Count(); count != 1 {
+		t.Errorf("Expected 1, got %d", count)
+	}
+}
+
+// Ensures that FillRatio counts non zero counters.
+func TestCountingBloomFillRatio(t *testing.T) {
+	f, _ := NewCountingBloomFilter(FilterOptions{N: 100, ErrorRate: 0.1})
+	f.Add([]byte(`a`))
+	f.Add([]byte(`a`))
+	f.Add([]byte(`b`))
+	f.Add([]byte(`c`))
+
+	if ratio := f.FillRatio(); ratio != 0.025 {
+		t.Errorf("Expected 0.025, got %f", ratio)
+	}
+}
+
+func TestCountingBloomDumpLoad(t *testing.T) {
+	c, _ := NewCountingBloomFilter(FilterOptions{Name: "test", N: 100, ErrorRate: 0.1})
+	for i := 0; i < 10; i++ {
+		c.Add([]byte(strconv.Itoa(i)))
+	}
+
+	buffer := new(bytes.Buffer)
+	if err := dumpFilter(buffer, c); err != nil {
+		t.Errorf("dump filter error: %v", err)
+		return
+	}
+
+	f, err := loadFilter(buffer)
+	if err != nil {
+		t.Errorf("load filter error: %v", err)
+		return
+	}
+
+	a, b := c.(*CountingBloomFilter), f.(*CountingBloomFilter)
+	if a.name != b.name || a.m != b.m || a.k != b.k || a.count != b.count || a.errorRate != b.errorRate || !bucketsEqual(a.buckets, b.buckets) {
+		t.Errorf("load filter error")
+	}
+
+	if !b.Remove([]byte("1")) || b.Test([]byte("1")) {
+		t.Errorf("remove after load error")
+	}
+}
@@ -0,0 +1,334 @@
+package bloom
+
+/*
+ *  @Describe: cuckoo filter, keeps a fingerprint of each key in one of two
+ *  candidate buckets. It takes less memory than classic filter for low error
+ *  rates and supports removing, but adding fails when it's full.
+ */
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sync"
+
+	"github.com/alecthomas/log4go"
+)
+
+const (
+	CUCKOO_BUCKET_ENTRIES = 4    // fingerprints per bucket
+	CUCKOO_LOAD_FACTOR    = 0.92 // load of n keys, a bit below the 95% it fills up to
+	CUCKOO_MAX_KICKS      = 500  // relocations tried before it's full
+)
+
+type CuckooFilter struct {
+	sync.RWMutex
+
+	name      string
+	buckets   uint    // number of buckets
+	fpBits    uint    // bits of each fingerprint
+	count     uint    // number of fingerprints stored
+	errorRate float64 // configured false positive rate
+	hash      byte    // kind of hash function
+
+	table *Buckets // fingerprints, zero is empty
+}
+
+func NewCuckooFilter(options FilterOptions) (Filter, error) {
+	if options.ErrorRate <= 0 || options.ErrorRate >= 1 || options.N == 0 {
+		return nil, fmt.Errorf("illegal params")
+	}
+
+	hash, err := hashKindOf(options.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	// a lookup compares 2 buckets of fingerprints, each matches with 1/2^f
+	fpBits := uint(math.Ceil(math.Log2(2 * CUCKOO_BUCKET_ENTRIES / options.ErrorRate)))
+	if fpBits > 32 {
+		return nil, fmt.Errorf("error rate %v is too low", options.ErrorRate)
+	}
+	buckets := uint(math.Ceil(float64(options.N) / CUCKOO_BUCKET_ENTRIES / CUCKOO_LOAD_FACTOR))
+
+	return &CuckooFilter{
+		name:      options.Name,
+		buckets:   buckets,
+		fpBits:    fpBits,
+		errorRate: options.ErrorRate,
+		hash:      hash,
+		table:     NewBuckets(buckets*CUCKOO_BUCKET_ENTRIES, uint8(fpBits)),
+	}, nil
+}
+
+func (b *CuckooFilter) Name() string {
+	return b.name
+}
+
+// Capacity returns number of fingerprint slots
+func (b *CuckooFilter) Capacity() uint {
+	return b.buckets * CUCKOO_BUCKET_ENTRIES
+}
+
+// K returns number of candidate buckets of a key
+func (b *CuckooFilter) K() uint {
+	return 2
+}
+
+func (b *CuckooFilter) Count() uint {
+	b.RLock()
+	defer b.RUnlock()
+
+	return b.count
+}
+
+func (b *CuckooFilter) ErrorRate() float64 {
+	return b.errorRate
+}
+
+func (b *CuckooFilter) Storage() uint64 {
+	return b.table.Storage()
+}
+
+func (b *CuckooFilter) EstimatedFillRatio() float64 {
+	return float64(b.Count()) / float64(b.Capacity())
+}
+
+func (b *CuckooFilter) FillRatio() float64 {
+	b.RLock()
+	defer b.RUnlock()
+
+	sum := uint(0)
+	for i := uint(0); i < b.table.Count(); i++ {
+		if b.table.Get(i) != 0 {
+			sum++
+		}
+	}
+	return float64(sum) / float64(b.table.Count())
+}
+
+func (b *CuckooFilter) PeriodMaintaince(persister FilterPersister, force bool) error {
+	if force {
+		log4go.Info("period dump cuckoo filter: %s", b.name)
+		return persistFilter(persister, b)
+	}
+
+	return nil
+}
+
+// locate returns the fingerprint and the two candidate buckets of data
+func (b *CuckooFilter) locate(data []byte) (uint32, uint, uint) {
+	h1, h2 := hashKeys(b.hash, data)
+
+	fp := uint32(h2) & uint32(1<<b.fpBits-1)
+	if fp == 0 {
+		fp = 1
+	}
+
+	i1 := uint(h1 % uint64(b.buckets))
+	return fp, i1, b.alt(i1, fp)
+}
+
+// alt returns the other bucket of fingerprint fp in bucket i, alt(alt(i)) is i
+func (b *CuckooFilter) alt(i uint, fp uint32) uint {
+	h := uint(fmix64(uint64(fp)) % uint64(b.buckets))
+	return (h + b.buckets - i) % b.buckets
+}
+
+func (b *CuckooFilter) has(i uint, fp uint32) int {
+	for j := uint(0); j < CUCKOO_BUCKET_ENTRIES; j++ {
+		if b.table.Get(i*CUCKOO_BUCKET_ENTRIES+j) == fp {
+			return int(j)
+		}
+	}
+
+	return -1
+}
+
+func (b *CuckooFilter) put(i uint, fp uint32) bool {
+	if j := b.has(i, 0); j >= 0 {
+		b.table.SetValue(i*CUCKOO_BUCKET_ENTRIES+uint(j), fp)
+		return true
+	}
+
+	return false
+}
+
+func (b *CuckooFilter) test(fp uint32, i1, i2 uint) bool {
+	return b.has(i1, fp) >= 0 || b.has(i2, fp) >= 0
+}
+
+func (b *CuckooFilter) Test(data []byte) bool {
+	fp, i1, i2 := b.locate(data)
+
+	b.RLock()
+	defer b.RUnlock()
+
+	return b.test(fp, i1, i2)
+}
+
+// Add inserts data, it's dropped with a warning when the filter is full, use
+// Insert to get the error
+func (b *CuckooFilter) Add(data []byte) Filter {
+	if err := b.Insert(data); err != nil {
+		log4go.Warn("add key to cuckoo filter %s error: %v", b.name, err)
+	}
+
+	return b
+}
+
+func (b *CuckooFilter) Insert(data []byte) error {
+	fp, i1, i2 := b.locate(data)
+
+	b.Lock()
+	defer b.Unlock()
+
+	return b.insert(fp, i1, i2)
+}
+
+func (b *CuckooFilter) TestAndAdd(data []byte) bool {
+	exists, err := b.TestAndInsert(data)
+	if err != nil {
+		log4go.Warn("add key to cuckoo filter %s error: %v", b.name, err)
+	}
+
+	return exists
+}
+
+func (b *CuckooFilter) TestAndInsert(data []byte) (bool, error) {
+	fp, i1, i2 := b.locate(data)
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.test(fp, i1, i2) {
+		return true, nil
+	}
+
+	return false, b.insert(fp, i1, i2)
+}
+
+// insert relocates fingerprints to make room for fp, the relocations are
+// reverted if it fails, so a full filter keeps all keys added before
+func (b *CuckooFilter) insert(fp uint32, i1, i2 uint) error {
+	if b.put(i1, fp) || b.put(i2, fp) {
+		b.count++
+		return nil
+	}
+
+	type kick struct {
+		slot uint
+		fp   uint32
+	}
+	kicks := make([]kick, 0, CUCKOO_MAX_KICKS)
+
+	i := i1
+	if rand.Intn(2) == 1 {
+		i = i2
+	}
+
+	for n := 0; n < CUCKOO_MAX_KICKS; n++ {
+		slot := i*CUCKOO_BUCKET_ENTRIES + uint(rand.Intn(CUCKOO_BUCKET_ENTRIES))
+		victim := b.table.Get(slot)
+		b.table.SetValue(slot, fp)
+		kicks = append(kicks, kick{slot, victim})
+
+		fp = victim
+		i = b.alt(i, fp)
+		if b.put(i, fp) {
+			b.count++
+			return nil
+		}
+	}
+
+	for n := len(kicks) - 1; n >= 0; n-- {
+		b.table.SetValue(kicks[n].slot, kicks[n].fp)
+	}
+
+	return FILTER_FULL_ERROR
+}
+
+// Remove deletes one fingerprint of data, returns false if data is not a member.
+func (b *CuckooFilter) Remove(data []byte) bool {
+	fp, i1, i2 := b.locate(data)
+
+	b.Lock()
+	defer b.Unlock()
+
+	for _, i := range []uint{i1, i2} {
+		if j := b.has(i, fp); j >= 0 {
+			b.table.SetValue(i*CUCKOO_BUCKET_ENTRIES+uint(j), 0)
+			b.count--
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *CuckooFilter) Reset() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.table.Reset()
+	b.count = 0
+}
+
+func (b *CuckooFilter) Load(stream io.Reader) error {
+	b.Lock()
+	defer b.Unlock()
+
+	r := newBinReader(stream)
+	t, meta := r.Section()
+	if r.err != nil || t != SECTION_CUCKOO {
+		log4go.Warn("read cuckoo filter header error")
+		return ILLEGAL_LOAD_FORMAT
+	}
+
+	b.name = meta.String()
+	b.buckets = uint(meta.U64())
+	b.fpBits = uint(meta.U32())
+	b.count = uint(meta.U64())
+	b.errorRate = meta.F64()
+	b.hash = meta.U8()
+	if hashName(b.hash) == "" {
+		log4go.Warn("unknown hash kind %d", b.hash)
+		return ILLEGAL_LOAD_FORMAT
+	}
+	b.table = &Buckets{}
+	log4go.Info("loaded cuckoo filter name:%s buckets:%d fingerprint:%d count:%d", b.name, b.buckets, b.fpBits, b.count)
+
+	if err := b.table.Load(r); err != nil {
+		return err
+	}
+	if b.buckets == 0 || b.table.Count() != b.buckets*CUCKOO_BUCKET_ENTRIES || uint(b.table.bucketSize) != b.fpBits {
+		log4go.Warn("fingerprints size %d count %d mismatch buckets %d", b.table.bucketSize, b.table.Count(), b.buckets)
+		return ILLEGAL_LOAD_FORMAT
+	}
+
+	return nil
+}
+
+func (b *CuckooFilter) Dump(stream io.Writer) error {
+	b.RLock()
+	defer b.RUnlock()
+
+	w := newBinWriter(stream)
+
+	w.Section(SECTION_CUCKOO, func(meta *binWriter) {
+		meta.String(b.name)
+		meta.U64(uint64(b.buckets))
+		meta.U32(uint32(b.fpBits))
+		meta.U64(uint64(b.count))
+		meta.F64(b.errorRate)
+		meta.U8(b.hash)
+	})
+	if w.err != nil {
+		log4go.Warn("encode error: %v", w.err)
+		return w.err
+	}
+	log4go.Info("dumped cuckoo filter header with name:%s buckets:%d fingerprint:%d count:%d", b.name, b.buckets, b.fpBits, b.count)
+
+	return b.table.Dump(w)
+}
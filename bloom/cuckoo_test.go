@@ -0,0 +1,144 @@
+package bloom
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+// Ensures that Test, Add and Remove behave correctly.
+func TestCuckooFilterRemove(t *testing.T) {
+	fs, _ := NewCuckooFilter(FilterOptions{N: 100, ErrorRate: 0.01})
+	f := fs.(*CuckooFilter)
+
+	if f.Remove([]byte(`a`)) {
+		t.Error("`a` should not be removed")
+	}
+
+	f.Add([]byte(`a`))
+	f.Add([]byte(`b`))
+	f.Add([]byte(`b`))
+
+	if !f.Test([]byte(`a`)) || !f.Test([]byte(`b`)) {
+		t.Error("`a` and `b` should be members")
+	}
+
+	if !f.Remove([]byte(`a`)) {
+		t.Error("`a` should be removed")
+	}
+
+	if f.Test([]byte(`a`)) {
+		t.Error("`a` should not be a member")
+	}
+
+	if !f.Remove([]byte(`b`)) || !f.Test([]byte(`b`)) {
+		t.Error("`b` was added twice, should still be a member")
+	}
+
+	if count := f.Count(); count != 1 {
+		t.Errorf("Expected 1, got %d", count)
+	}
+
+	if f.TestAndAdd([]byte(`c`)) || !f.TestAndAdd([]byte(`c`)) {
+		t.Error("`c` should be added once")
+	}
+}
+
+// Ensures that a full filter reports errors and keeps keys added before.
+func TestCuckooFilterFull(t *testing.T) {
+	fs, _ := NewCuckooFilter(FilterOptions{Name: "test", N: 1000, ErrorRate: 0.001})
+	f := fs.(*CuckooFilter)
+
+	added := 0
+	for i := 0; i < 2000; i++ {
+		if err := f.Insert([]byte(strconv.Itoa(i))); err != nil {
+			if err != FILTER_FULL_ERROR {
+				t.Errorf("Expected full error, got %v", err)
+			}
+			break
+		}
+		added++
+	}
+
+	if added < 900 || added >= 2000 {
+		t.Errorf("Expected to be full after about 1000 keys, added %d", added)
+	}
+	if count := f.Count(); count != uint(added) {
+		t.Errorf("Expected %d, got %d", added, count)
+	}
+	for i := 0; i < added; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("%d should be a member", i)
+		}
+	}
+
+	keys := make([]string, 200)
+	for i := range keys {
+		keys[i] = strconv.Itoa(2000 + i)
+	}
+	if err := BatchAdd(f, keys[:100], true); err == nil {
+		t.Error("batch add to full filter should fail")
+	}
+	if _, _, err := batchTestAndInsert(f, keys[100:]); err == nil {
+		t.Error("test and add to full filter should fail")
+	}
+}
+
+// Ensures that cuckoo filter keeps its false positive rate with less memory
+// than classic filter.
+func TestCuckooFilterErrorRate(t *testing.T) {
+	options := FilterOptions{Name: "test", N: 10000, ErrorRate: 0.001}
+	f, _ := NewCuckooFilter(options)
+	for i := 0; i < 10000; i++ {
+		if err := f.(*CuckooFilter).Insert([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("insert %d error: %v", i, err)
+		}
+	}
+
+	rate := falsePositiveRate(f, 10000, 100000)
+	if rate > 0.002 {
+		t.Errorf("false positive rate %f is too high", rate)
+	}
+
+	if estimated := EstimatedFalsePositiveRate(f); estimated < rate/2 || estimated > 0.002 {
+		t.Errorf("estimated false positive rate %f should be near %f", estimated, rate)
+	}
+
+	classic, _ := NewClassicBloomFilter(options)
+	if f.Storage() >= classic.Storage() {
+		t.Errorf("storage %d should be less than classic %d", f.Storage(), classic.Storage())
+	}
+}
+
+func TestCuckooFilterDumpLoad(t *testing.T) {
+	f, _ := NewCuckooFilter(FilterOptions{Name: "test", N: 1000, ErrorRate: 0.01, Hash: HASH_MURMUR3})
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	buf := &bytes.Buffer{}
+	if err := WriteDump(buf, f); err != nil {
+		t.Fatalf("dump error: %v", err)
+	}
+
+	loaded, _, err := LoadDump(buf)
+	if err != nil {
+		t.Fatalf("load error: %v", err)
+	}
+
+	l, ok := loaded.(*CuckooFilter)
+	if !ok {
+		t.Fatalf("expected cuckoo filter, got %s", filterType(loaded))
+	}
+	if l.Name() != "test" || l.Capacity() != f.Capacity() || l.Count() != 1000 || HashOf(l) != HASH_MURMUR3 {
+		t.Errorf("loaded filter mismatch, name:%s capacity:%d count:%d hash:%s", l.Name(), l.Capacity(), l.Count(), HashOf(l))
+	}
+	for i := 0; i < 1000; i++ {
+		if !l.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("%d should be a member", i)
+		}
+	}
+	if !l.Remove([]byte("1")) || l.Count() != 999 {
+		t.Error("1 should be removed from loaded filter")
+	}
+}
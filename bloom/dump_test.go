@@ -3,6 +3,9 @@ package bloom
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
 	"flag"
 	"fmt"
 	"io"
@@ -81,6 +84,11 @@ func (b *TestBuffer) Close() error {
 	return nil
 }
 
+func (b *TestBuffer) Abort() error {
+	b.Reset()
+	return nil
+}
+
 func (t *TestPersister) NewWriter(filterName string) (Writer, error) {
 	return &t.buffer, nil
 }
@@ -90,6 +98,19 @@ func (t *TestPersister) NewReader(filterName string) (*bufio.Reader, io.Closer,
 func (t *TestPersister) ListFilterNames() ([]string, error) {
 	return nil, nil
 }
+func (t *TestPersister) Remove(filterName string) error {
+	t.buffer.Reset()
+	return nil
+}
+func (t *TestPersister) OpenLog(filterName string) (*AddLog, error) {
+	return nil, nil
+}
+func (t *TestPersister) ListSnapshots(filterName string) ([]Snapshot, error) {
+	return nil, nil
+}
+func (t *TestPersister) NewSnapshotReader(filterName string, timestamp int64) (*bufio.Reader, io.Closer, error) {
+	return t.NewReader(filterName)
+}
 func (t *TestPersister) UseGzip() bool {
 	return true
 }
@@ -110,39 +131,41 @@ func TestRotated(t *testing.T) {
 	f := c.(*RotatedBloomFilter)
 	before := f.lastRotated
 
-	if err := f.PeriodMaintaince(&TestPersister{}, false); err != nil {
+	// rotation is left to the scheduler of manager
+	if err := f.PeriodMaintaince(&TestPersister{}, true); err != nil {
 		t.Errorf("period maintance err:%v", err)
 		return
 	}
-	if f.lastRotated == before {
+	if f.lastRotated != before || f.current != 0 {
 		t.Errorf("should not rotated")
 		return
 	}
 
-	time.Sleep(1 * time.Second)
-	if err := f.PeriodMaintaince(&TestPersister{}, false); err != nil {
-		t.Errorf("period maitaince err: %v", err)
-		return
+	if n := f.rotate(before.Add(500 * time.Millisecond)); n != 0 {
+		t.Errorf("should not rotated before interval, rotated %d", n)
 	}
 
-	if f.lastRotated == before {
-		t.Errorf("should rotated")
-		return
+	if n := f.rotate(before.Add(1500 * time.Millisecond)); n != 1 || f.current != 1 {
+		t.Errorf("should rotated once, rotated %d current %d", n, f.current)
 	}
-	if f.current != 2 {
-		t.Errorf("drop one error")
+	if !f.lastRotated.Equal(before.Add(time.Second)) {
+		t.Errorf("rotation should keep aligned, last rotated %v", f.lastRotated)
 	}
 
-	before = f.lastRotated
-	//maintaince again, should not rotated
-	if err := f.PeriodMaintaince(&TestPersister{}, false); err != nil {
-		t.Errorf("period maitaince err: %v", err)
-		return
+	//late for 3 intervals, drops 3 generations
+	if n := f.rotate(before.Add(4 * time.Second)); n != 3 || f.current != 4 {
+		t.Errorf("should rotated 3 times, rotated %d current %d", n, f.current)
 	}
 
-	if f.lastRotated != before {
-		t.Errorf("should not rotated")
-		return
+	f.Add([]byte("a"))
+	//late for more than r intervals, drops all generations
+	if n := f.rotate(before.Add(20 * time.Second)); n != 16 || f.current != 4 {
+		t.Errorf("should rotated 16 times, rotated %d current %d", n, f.current)
+	}
+	for i, inner := range f.innerFilters {
+		if inner.Test([]byte("a")) {
+			t.Errorf("generation %d should be reset", i)
+		}
 	}
 }
 
@@ -185,3 +208,191 @@ func TestMain(m *testing.M) {
 	defer log4go.Close()
 	os.Exit(m.Run())
 }
+
+// Ensures that corrupted or truncated dumps are detected by checksum.
+func TestDumpChecksum(t *testing.T) {
+	for _, useGzip := range []bool{true, false} {
+		UseGzip = useGzip
+
+		c, _ := NewClassicBloomFilter(FilterOptions{Name: "test", ErrorRate: 0.01, N: 10000})
+		c.Add([]byte("a"))
+
+		buffer := new(bytes.Buffer)
+		if err := dumpFilter(buffer, c); err != nil {
+			t.Errorf("dump filter error: %v", err)
+			continue
+		}
+		data := buffer.Bytes()
+
+		header, err := CheckDump(bytes.NewBuffer(data))
+		if err != nil || header.Version != DUMP_VERSION {
+			t.Errorf("check dump error: %v %+v", err, header)
+		}
+
+		corrupted := append([]byte{}, data...)
+		corrupted[len(corrupted)-100] ^= 0x1
+		if err := CheckFilter(bytes.NewBuffer(corrupted)); err == nil {
+			t.Errorf("corrupted dump should fail, gzip:%v", useGzip)
+		}
+
+		if err := CheckFilter(bytes.NewBuffer(data[:len(data)-6])); err == nil {
+			t.Errorf("truncated dump should fail, gzip:%v", useGzip)
+		}
+	}
+
+	UseGzip = true
+}
+
+// dumpLegacyClassic writes c as a gob dump of the given legacy version.
+func dumpLegacyClassic(w io.Writer, c *ClassicBloomFilter, version uint) {
+	gob.NewEncoder(w).Encode(&DumpHeader{
+		Magic:          MAGIC_NUM,
+		FilterUsedGzip: true,
+		FilterType:     FILTER_CLASSIC,
+		Version:        version,
+	})
+
+	var checksum *checksumWriter
+	if version >= DUMP_VERSION_CHECKSUM {
+		checksum = newChecksumWriter(w)
+		w = checksum
+	}
+
+	gwriter := gzip.NewWriter(w)
+	enc := gob.NewEncoder(gwriter)
+	enc.Encode(&ClassicBloomFilterDumpHeader{
+		Name:      c.name,
+		M:         c.m,
+		K:         c.k,
+		Count:     uint(c.count),
+		ErrorRate: c.errorRate,
+	})
+	enc.Encode(&BucketsDump{
+		Data:  bitsetBytes(c.bits),
+		Max:   1,
+		Size:  1,
+		Count: c.bits.count,
+	})
+	gwriter.Close()
+
+	if checksum != nil {
+		checksum.Close()
+	}
+}
+
+// Ensures that gob dumps before the binary format can still be loaded and converted.
+func TestLoadLegacyDump(t *testing.T) {
+	c, _ := NewClassicBloomFilter(FilterOptions{Name: "test", ErrorRate: 0.01, N: 10000})
+	c.Add([]byte("a"))
+
+	for _, version := range []uint{DUMP_VERSION_LEGACY, DUMP_VERSION_CHECKSUM} {
+		buffer := new(bytes.Buffer)
+		dumpLegacyClassic(buffer, c.(*ClassicBloomFilter), version)
+
+		converted := new(bytes.Buffer)
+		header, err := ConvertDump(buffer, converted)
+		if err != nil {
+			t.Errorf("convert legacy dump version %d error: %v", version, err)
+			continue
+		}
+		if header.Version != version || header.FilterType != FILTER_CLASSIC {
+			t.Errorf("legacy header error: %+v", header)
+		}
+
+		f, err := loadFilter(converted)
+		if err != nil {
+			t.Errorf("load converted dump error: %v", err)
+			continue
+		}
+
+		if !classicBloomFilterEqual(f.(*ClassicBloomFilter), c.(*ClassicBloomFilter)) {
+			t.Errorf("load legacy dump version %d content error", version)
+		}
+	}
+}
+
+// Ensures that the bit array of an uncompressed dump is 8 bytes aligned.
+func TestBinaryDumpLayout(t *testing.T) {
+	UseGzip = false
+	defer func() { UseGzip = true }()
+
+	c, _ := NewClassicBloomFilter(FilterOptions{Name: "abc", ErrorRate: 0.01, N: 1000})
+	c.Add([]byte("a"))
+
+	buffer := new(bytes.Buffer)
+	if err := dumpFilter(buffer, c); err != nil {
+		t.Errorf("dump filter error: %v", err)
+		return
+	}
+
+	data := buffer.Bytes()
+	if string(data[:4]) != BINARY_MAGIC || data[8] != SECTION_CLASSIC {
+		t.Errorf("dump header error: %v", data[:16])
+	}
+
+	raw := bitsetBytes(c.(*ClassicBloomFilter).bits)
+	// padded bit array ends right before the crc
+	start := len(data) - 4 - (len(raw)+7)/8*8
+	if start%8 != 0 || !bytes.Equal(data[start:start+len(raw)], raw) {
+		t.Errorf("bit array not aligned")
+	}
+}
+
+// Ensures that corrupted counts before the crc fail to load instead of
+// allocating what they claim.
+func TestDumpCorruptedCounts(t *testing.T) {
+	UseGzip = false
+	defer func() { UseGzip = true }()
+
+	rotated, _ := NewRotatedBloomFilter(FilterOptions{Name: "abc", ErrorRate: 0.01, N: 1000, R: 3, RotateInterval: time.Hour})
+	scalable, _ := NewScalableBloomFilter(FilterOptions{Name: "abc", ErrorRate: 0.01, N: 1000})
+
+	// meta starts at 13 after header, type and meta length, then name of 2+3 bytes
+	for _, c := range []struct {
+		filter Filter
+		offset int
+	}{
+		{rotated, 13 + 5 + 3},          // high byte of r
+		{scalable, 13 + 5 + 8 + 8 + 3}, // high byte of stages
+		{rotated, 12},                  // high byte of meta length
+	} {
+		buffer := new(bytes.Buffer)
+		dumpFilter(buffer, c.filter)
+		data := buffer.Bytes()
+		data[c.offset] = 0x7f
+
+		if _, _, err := LoadDump(bytes.NewBuffer(data)); err == nil {
+			t.Errorf("corrupted %T at %d should fail", c.filter, c.offset)
+		}
+	}
+}
+
+// Ensures that huge buckets counts in a corrupted dump fail without
+// allocating by them.
+func TestDumpCorruptedBucketsCount(t *testing.T) {
+	UseGzip = false
+	defer func() { UseGzip = true }()
+
+	classic, _ := NewClassicBloomFilter(FilterOptions{Name: "abc", ErrorRate: 0.01, N: 1000})
+	counting, _ := NewCountingBloomFilter(FilterOptions{Name: "abc", ErrorRate: 0.01, N: 1000})
+	cuckoo, _ := NewCuckooFilter(FilterOptions{Name: "abc", ErrorRate: 0.01, N: 1000})
+
+	for _, filter := range []Filter{classic, counting, cuckoo} {
+		buffer := new(bytes.Buffer)
+		dumpFilter(buffer, filter)
+		data := buffer.Bytes()
+
+		// buckets header is bits per bucket, reserved, count and length,
+		// right after meta which ends at 13 plus meta length
+		off := 13 + int(binary.LittleEndian.Uint32(data[9:]))
+		off += (8 - off%8) % 8
+		size := uint64(binary.LittleEndian.Uint32(data[off:]))
+		count := uint64(1) << 50
+		binary.LittleEndian.PutUint64(data[off+8:], count)
+		binary.LittleEndian.PutUint64(data[off+16:], (count*size+7)/8)
+
+		if _, _, err := LoadDump(bytes.NewBuffer(data)); err == nil {
+			t.Errorf("corrupted buckets count of %T should fail", filter)
+		}
+	}
+}
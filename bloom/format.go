@@ -0,0 +1,453 @@
+package bloom
+
+/*
+ *  @Describe: binary dump format
+ *
+ *  All integers are little endian. A dump file is laid out as:
+ *
+ *    offset  size  field
+ *    0       4     magic "\x89BFD"
+ *    4       2     format version, DUMP_VERSION_BINARY
+ *    6       2     flags, bit 0 set if the body is gzip compressed, bit 1
+ *                  set if the body starts with log start
+ *    8       -     body, log start if flagged then a filter section
+ *    -       4     crc32 (IEEE) of the body as stored
+ *
+ *  log start is i64, the first segment of add log not in the dump, which
+ *  is replayed over it when recovering.
+ *
+ *  A filter section is:
+ *
+ *    size  field
+ *    1     filter type, see SECTION_* below
+ *    4     meta length
+ *    -     meta, fields of the filter type in order
+ *    -     payload of the filter type
+ *
+ *  Readers ignore unknown trailing meta fields and take missing ones as
+ *  zero, so fields can be appended without bumping the version.
+ *
+ *    classic, counting  meta:    name, m u64, k u32, count u64, error_rate f64,
+ *                                hash u8
+ *                       payload: buckets
+ *    rotated            meta:    name, r u32, current u32,
+ *                                rotate_interval i64 (ns), last_rotated i64 (unix ns),
+ *                                created i64 (unix ns), newest_only u8
+ *                       payload: r filter sections
+ *    scalable           meta:    name, n u64, error_rate f64, stages u32, hash u8
+ *                       payload: stages filter sections
+ *    blocked            meta:    same as classic, m is a multiple of 512
+ *                       payload: buckets
+ *    cuckoo             meta:    name, buckets u64, fingerprint_bits u32, count u64,
+ *                                error_rate f64, hash u8
+ *                       payload: buckets of 4 fingerprints per bucket, zero is empty
+ *    ttl                meta:    name, m u64, k u32, error_rate f64, hash u8, ttl i64 (ns),
+ *                                swept u64 (epoch of last decay), latest u64 (epoch of latest add)
+ *                       payload: buckets of 8 bits epoch stamps, zero is empty
+ *
+ *  hash is HASH_KIND_*, zero (fnv64) for dumps before it was added.
+ *
+ *  strings are u16 length followed by bytes. buckets are:
+ *
+ *    size  field
+ *    -     zero padding up to 8 bytes alignment from offset 0
+ *    4     bits per bucket
+ *    4     reserved
+ *    8     buckets count
+ *    8     data length in bytes
+ *    -     raw data, bucket i holds bits [i*size, (i+1)*size), bit j is
+ *          bit (j%8) of byte (j/8), least significant first
+ *    -     zero padding up to 8 bytes alignment
+ *
+ *  So in an uncompressed dump the raw data can be mmapped and viewed as
+ *  []uint64 on little endian machines.
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+const (
+	BINARY_MAGIC = "\x89BFD"
+
+	DUMP_FLAG_GZIP = 1 << 0
+	DUMP_FLAG_LOG  = 1 << 1
+
+	BINARY_READ_CHUNK = 1 << 20 // bytes read at once for unchecked lengths
+
+	SECTION_CLASSIC  = byte(1)
+	SECTION_ROTATED  = byte(2)
+	SECTION_COUNTING = byte(3)
+	SECTION_SCALABLE = byte(4)
+	SECTION_BLOCKED  = byte(5)
+	SECTION_CUCKOO   = byte(6)
+	SECTION_TTL      = byte(7)
+)
+
+// binWriter writes little endian fields and tracks the offset for alignment,
+// nested filters share the writer of their parent
+type binWriter struct {
+	w   io.Writer
+	off int64
+	err error
+	buf [8]byte
+}
+
+func newBinWriter(w io.Writer) *binWriter {
+	if bw, ok := w.(*binWriter); ok {
+		return bw
+	}
+
+	return &binWriter{w: w}
+}
+
+func (w *binWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	n, err := w.w.Write(p)
+	w.off += int64(n)
+	w.err = err
+	return n, err
+}
+
+func (w *binWriter) U8(v uint8) {
+	w.buf[0] = v
+	w.Write(w.buf[:1])
+}
+
+func (w *binWriter) U16(v uint16) {
+	binary.LittleEndian.PutUint16(w.buf[:2], v)
+	w.Write(w.buf[:2])
+}
+
+func (w *binWriter) U32(v uint32) {
+	binary.LittleEndian.PutUint32(w.buf[:4], v)
+	w.Write(w.buf[:4])
+}
+
+func (w *binWriter) U64(v uint64) {
+	binary.LittleEndian.PutUint64(w.buf[:8], v)
+	w.Write(w.buf[:8])
+}
+
+func (w *binWriter) I64(v int64) {
+	w.U64(uint64(v))
+}
+
+func (w *binWriter) F64(v float64) {
+	w.U64(math.Float64bits(v))
+}
+
+func (w *binWriter) String(s string) {
+	if len(s) > math.MaxUint16 {
+		w.err = fmt.Errorf("string too long: %d", len(s))
+		return
+	}
+
+	w.U16(uint16(len(s)))
+	w.Write([]byte(s))
+}
+
+func (w *binWriter) Pad(align int64) {
+	if n := (align - w.off%align) % align; n > 0 {
+		w.Write(make([]byte, n))
+	}
+}
+
+// Section writes type, meta built by fn and its length
+func (w *binWriter) Section(t byte, fn func(meta *binWriter)) {
+	buffer := new(bytes.Buffer)
+	meta := &binWriter{w: buffer}
+	fn(meta)
+	if meta.err != nil {
+		w.err = meta.err
+		return
+	}
+
+	w.U8(t)
+	w.U32(uint32(buffer.Len()))
+	w.Write(buffer.Bytes())
+}
+
+type binReader struct {
+	r   io.Reader
+	off int64
+	err error
+	buf [8]byte
+
+	peeked bool
+	peek   byte
+}
+
+func newBinReader(r io.Reader) *binReader {
+	if br, ok := r.(*binReader); ok {
+		return br
+	}
+
+	return &binReader{r: r}
+}
+
+func (r *binReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	start := 0
+	if r.peeked {
+		p[0] = r.peek
+		r.peeked = false
+		start = 1
+	}
+
+	n, err := io.ReadFull(r.r, p[start:])
+	r.off += int64(n)
+	r.err = err
+	return start + n, err
+}
+
+// Peek returns the next byte without consuming it
+func (r *binReader) Peek() byte {
+	if r.peeked {
+		return r.peek
+	}
+
+	r.peek = r.U8()
+	r.peeked = r.err == nil
+	return r.peek
+}
+
+func (r *binReader) U8() uint8 {
+	if _, err := r.Read(r.buf[:1]); err != nil {
+		return 0
+	}
+	return r.buf[0]
+}
+
+func (r *binReader) U16() uint16 {
+	if _, err := r.Read(r.buf[:2]); err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(r.buf[:2])
+}
+
+func (r *binReader) U32() uint32 {
+	if _, err := r.Read(r.buf[:4]); err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(r.buf[:4])
+}
+
+func (r *binReader) U64() uint64 {
+	if _, err := r.Read(r.buf[:8]); err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(r.buf[:8])
+}
+
+func (r *binReader) I64() int64 {
+	return int64(r.U64())
+}
+
+func (r *binReader) F64() float64 {
+	return math.Float64frombits(r.U64())
+}
+
+func (r *binReader) String() string {
+	b := make([]byte, r.U16())
+	r.Read(b)
+	return string(b)
+}
+
+// Bytes reads n bytes, which aren't checked by crc yet, so the result grows
+// as read and a corrupted n fails at the end of stream rather than
+// allocating it all
+func (r *binReader) Bytes(n uint64) []byte {
+	var b []byte
+	for uint64(len(b)) < n && r.err == nil {
+		end := uint64(len(b)) + BINARY_READ_CHUNK
+		if end > n {
+			end = n
+		}
+
+		if uint64(cap(b)) < end {
+			grown := make([]byte, len(b), growCap(uint64(cap(b)), end, n))
+			copy(grown, b)
+			b = grown
+		}
+
+		start := len(b)
+		b = b[:end]
+		r.Read(b[start:])
+	}
+
+	return b
+}
+
+// growCap doubles capacity c to hold at least need, but not more than max
+func growCap(c, need, max uint64) uint64 {
+	c *= 2
+	if c < need {
+		c = need
+	}
+	if c > max {
+		c = max
+	}
+
+	return c
+}
+
+func (r *binReader) Pad(align int64) {
+	if n := (align - r.off%align) % align; n > 0 {
+		r.Read(make([]byte, n))
+	}
+}
+
+// Section reads type and meta, missing meta fields are read as zero
+func (r *binReader) Section() (byte, *binReader) {
+	t := r.U8()
+	length := r.U32()
+
+	// length isn't checked by crc yet, meta grows as read so a corrupted
+	// one fails at the end of stream rather than allocating it all
+	meta := new(bytes.Buffer)
+	if r.err == nil {
+		io.CopyN(meta, r, int64(length))
+	}
+
+	return t, &binReader{r: &zeroPadReader{bytes.NewReader(meta.Bytes())}}
+}
+
+type zeroPadReader struct {
+	r io.Reader
+}
+
+func (z *zeroPadReader) Read(p []byte) (int, error) {
+	n, _ := z.r.Read(p)
+	for i := n; i < len(p); i++ {
+		p[i] = 0
+	}
+
+	return len(p), nil
+}
+
+// crcReader hashes all bytes read, it implements io.ByteReader so gzip and
+// flate never read ahead of the compressed body
+type crcReader struct {
+	r   io.ByteReader
+	rr  io.Reader
+	crc hash.Hash32
+	one [1]byte
+}
+
+func newCRCReader(r interface {
+	io.Reader
+	io.ByteReader
+}) *crcReader {
+	return &crcReader{r: r, rr: r, crc: crc32.NewIEEE()}
+}
+
+func (c *crcReader) Read(p []byte) (int, error) {
+	n, err := c.rr.Read(p)
+	c.crc.Write(p[:n])
+	return n, err
+}
+
+func (c *crcReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.one[0] = b
+		c.crc.Write(c.one[:])
+	}
+	return b, err
+}
+
+type crcWriter struct {
+	w   io.Writer
+	crc hash.Hash32
+}
+
+func (c *crcWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.crc.Write(p[:n])
+	return n, err
+}
+
+func sectionOfFilter(filter Filter) byte {
+	switch filter.(type) {
+	case *ClassicBloomFilter:
+		return SECTION_CLASSIC
+	case *RotatedBloomFilter:
+		return SECTION_ROTATED
+	case *CountingBloomFilter:
+		return SECTION_COUNTING
+	case *ScalableBloomFilter:
+		return SECTION_SCALABLE
+	case *BlockedBloomFilter:
+		return SECTION_BLOCKED
+	case *CuckooFilter:
+		return SECTION_CUCKOO
+	case *TTLBloomFilter:
+		return SECTION_TTL
+	default:
+		return 0
+	}
+}
+
+func newFilterOfSection(t byte) (Filter, error) {
+	switch t {
+	case SECTION_CLASSIC:
+		return &ClassicBloomFilter{}, nil
+	case SECTION_ROTATED:
+		return &RotatedBloomFilter{}, nil
+	case SECTION_COUNTING:
+		return &CountingBloomFilter{}, nil
+	case SECTION_SCALABLE:
+		return &ScalableBloomFilter{}, nil
+	case SECTION_BLOCKED:
+		return &BlockedBloomFilter{}, nil
+	case SECTION_CUCKOO:
+		return &CuckooFilter{}, nil
+	case SECTION_TTL:
+		return &TTLBloomFilter{}, nil
+	default:
+		return nil, fmt.Errorf("unknown filter section type: %d", t)
+	}
+}
+
+// loadSection creates filter by the type of next section and loads it
+func loadSection(r *binReader) (Filter, error) {
+	t := r.Peek()
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	filter, err := newFilterOfSection(t)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := filter.Load(r); err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+func dumpSection(w *binWriter, filter Filter) error {
+	if sectionOfFilter(filter) == 0 {
+		return fmt.Errorf("unknown filter type %T", filter)
+	}
+
+	return filter.Dump(w)
+}
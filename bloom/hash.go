@@ -0,0 +1,243 @@
+package bloom
+
+/*
+ *  @Describe: hash functions of filters
+ *
+ *  fnv64 is the hash of filters before hash was pluggable, it splits the
+ *  64-bit sum into two 32-bit halves. murmur3 and xxhash give two 64-bit
+ *  hashes, so the k locations (h1 + i*h2) % m stay independent for m over
+ *  2^32. xxhash takes the two from sums of different seeds, so keys
+ *  colliding in h1 rarely collide in h2 too.
+ */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+const (
+	HASH_FNV64   = "fnv64"
+	HASH_MURMUR3 = "murmur3"
+	HASH_XXHASH  = "xxhash"
+
+	// persisted in dumps, dumps without hash are fnv64
+	HASH_KIND_FNV64   = byte(0)
+	HASH_KIND_MURMUR3 = byte(1)
+	HASH_KIND_XXHASH  = byte(2)
+
+	XXHASH_SEED2 = 0x9e3779b97f4a7c15 // seed of xxhash h2, h1 is of seed 0
+)
+
+// hashKindOf returns kind of hash name, fnv64 if name is empty
+func hashKindOf(name string) (byte, error) {
+	switch name {
+	case "", HASH_FNV64:
+		return HASH_KIND_FNV64, nil
+	case HASH_MURMUR3:
+		return HASH_KIND_MURMUR3, nil
+	case HASH_XXHASH:
+		return HASH_KIND_XXHASH, nil
+	default:
+		return 0, fmt.Errorf("unknown hash: %s", name)
+	}
+}
+
+func hashName(kind byte) string {
+	switch kind {
+	case HASH_KIND_FNV64:
+		return HASH_FNV64
+	case HASH_KIND_MURMUR3:
+		return HASH_MURMUR3
+	case HASH_KIND_XXHASH:
+		return HASH_XXHASH
+	default:
+		return ""
+	}
+}
+
+// HashOf returns hash name of filter, hash of the first sub filter for
+// rotated and scalable filters
+func HashOf(filter Filter) string {
+	switch f := filter.(type) {
+	case *ClassicBloomFilter:
+		return hashName(f.hash)
+	case *CountingBloomFilter:
+		return hashName(f.hash)
+	case *BlockedBloomFilter:
+		return hashName(f.hash)
+	case *CuckooFilter:
+		return hashName(f.hash)
+	case *TTLBloomFilter:
+		return hashName(f.hash)
+	}
+
+	if subs := SubFilters(filter); len(subs) > 0 {
+		return HashOf(subs[0])
+	}
+	return ""
+}
+
+// hashKeys returns h1, h2 of data, location i of data is (h1 + i*h2) % m
+func hashKeys(kind byte, data []byte) (uint64, uint64) {
+	switch kind {
+	case HASH_KIND_MURMUR3:
+		return murmur3Sum128(data)
+	case HASH_KIND_XXHASH:
+		return xxhashSum64(data, 0), xxhashSum64(data, XXHASH_SEED2)
+	default:
+		lower, upper := hashKernel(data)
+		return uint64(lower), uint64(upper)
+	}
+}
+
+func location(h1, h2 uint64, i, m uint) uint {
+	return uint((h1 + h2*uint64(i)) % uint64(m))
+}
+
+func fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
+
+// murmur3Sum128 is MurmurHash3 x64 128 with seed 0
+func murmur3Sum128(data []byte) (uint64, uint64) {
+	const (
+		c1 = 0x87c37b91114253d5
+		c2 = 0x4cf5ad432745937f
+	)
+
+	var h1, h2 uint64
+	length := len(data)
+
+	for ; len(data) >= 16; data = data[16:] {
+		k1 := binary.LittleEndian.Uint64(data)
+		k2 := binary.LittleEndian.Uint64(data[8:])
+
+		k1 *= c1
+		k1 = bits.RotateLeft64(k1, 31)
+		k1 *= c2
+		h1 ^= k1
+
+		h1 = bits.RotateLeft64(h1, 27)
+		h1 += h2
+		h1 = h1*5 + 0x52dce729
+
+		k2 *= c2
+		k2 = bits.RotateLeft64(k2, 33)
+		k2 *= c1
+		h2 ^= k2
+
+		h2 = bits.RotateLeft64(h2, 31)
+		h2 += h1
+		h2 = h2*5 + 0x38495ab5
+	}
+
+	var k1, k2 uint64
+	if len(data) > 8 {
+		for i := len(data) - 1; i >= 8; i-- {
+			k2 ^= uint64(data[i]) << (8 * uint(i-8))
+		}
+		k2 *= c2
+		k2 = bits.RotateLeft64(k2, 33)
+		k2 *= c1
+		h2 ^= k2
+	}
+	if len(data) > 0 {
+		for i := len(data) - 1; i >= 0; i-- {
+			if i < 8 {
+				k1 ^= uint64(data[i]) << (8 * uint(i))
+			}
+		}
+		k1 *= c1
+		k1 = bits.RotateLeft64(k1, 31)
+		k1 *= c2
+		h1 ^= k1
+	}
+
+	h1 ^= uint64(length)
+	h2 ^= uint64(length)
+	h1 += h2
+	h2 += h1
+	h1 = fmix64(h1)
+	h2 = fmix64(h2)
+	h1 += h2
+	h2 += h1
+
+	return h1, h2
+}
+
+var (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func xxhashRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxhashMergeRound(acc, val uint64) uint64 {
+	acc ^= xxhashRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
+
+// xxhashSum64 is XXH64 with seed
+func xxhashSum64(data []byte, seed uint64) uint64 {
+	length := len(data)
+	var h uint64
+
+	if length >= 32 {
+		v1 := seed + xxPrime1 + xxPrime2
+		v2 := seed + xxPrime2
+		v3 := seed
+		v4 := seed - xxPrime1
+
+		for ; len(data) >= 32; data = data[32:] {
+			v1 = xxhashRound(v1, binary.LittleEndian.Uint64(data))
+			v2 = xxhashRound(v2, binary.LittleEndian.Uint64(data[8:]))
+			v3 = xxhashRound(v3, binary.LittleEndian.Uint64(data[16:]))
+			v4 = xxhashRound(v4, binary.LittleEndian.Uint64(data[24:]))
+		}
+
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxhashMergeRound(h, v1)
+		h = xxhashMergeRound(h, v2)
+		h = xxhashMergeRound(h, v3)
+		h = xxhashMergeRound(h, v4)
+	} else {
+		h = seed + xxPrime5
+	}
+
+	h += uint64(length)
+
+	for ; len(data) >= 8; data = data[8:] {
+		h ^= xxhashRound(0, binary.LittleEndian.Uint64(data))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(data) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(data)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		data = data[4:]
+	}
+	for ; len(data) > 0; data = data[1:] {
+		h ^= uint64(data[0]) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+
+	return h
+}
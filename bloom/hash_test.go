@@ -0,0 +1,123 @@
+package bloom
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+// Ensures that murmur3 and xxhash match the reference implementations.
+func TestHashVectors(t *testing.T) {
+	murmur3 := []struct {
+		data   string
+		h1, h2 uint64
+	}{
+		{"", 0, 0},
+		{"hello", 0xcbd8a7b341bd9b02, 0x5b1e906a48ae1d19},
+		{"The quick brown fox jumps over the lazy dog", 0xe34bbc7bbc071b6c, 0x7a433ca9c49a9347},
+	}
+	for _, v := range murmur3 {
+		if h1, h2 := murmur3Sum128([]byte(v.data)); h1 != v.h1 || h2 != v.h2 {
+			t.Errorf("murmur3 of %q expected %x%x, got %x%x", v.data, v.h1, v.h2, h1, h2)
+		}
+	}
+
+	xxhash := []struct {
+		data string
+		seed uint64
+		h    uint64
+	}{
+		{"", 0, 0xef46db3751d8e999},
+		{"a", 0, 0xd24ec4f1a98c6e5b},
+		{"abc", 0, 0x44bc2cf5ad770999},
+		{"Nobody inspects the spammish repetition", 0, 0xfbcea83c8a378bf1},
+		{"", XXHASH_SEED2, 0xc4349fc93c010000},
+		{"abc", XXHASH_SEED2, 0x2ed0f59d6b43ac8b},
+		{"Nobody inspects the spammish repetition", XXHASH_SEED2, 0xeb8b157ca26cbf34},
+	}
+	for _, v := range xxhash {
+		if h := xxhashSum64([]byte(v.data), v.seed); h != v.h {
+			t.Errorf("xxhash of %q with seed %x expected %x, got %x", v.data, v.seed, v.h, h)
+		}
+	}
+}
+
+// Ensures that filters work with every hash and keep it across dumps.
+func TestFilterHash(t *testing.T) {
+	for _, hash := range []string{"", HASH_FNV64, HASH_MURMUR3, HASH_XXHASH} {
+		for _, typ := range []string{FILTER_CLASSIC, FILTER_COUNTING, FILTER_SCALABLE, FILTER_ROTATED} {
+			f, err := NewFilter(typ, FilterOptions{Name: "test", ErrorRate: 0.01, N: 1000, R: 2, Hash: hash})
+			if err != nil {
+				t.Errorf("create %s filter with hash %s error: %v", typ, hash, err)
+				continue
+			}
+
+			for i := 0; i < 1000; i++ {
+				f.Add([]byte(strconv.Itoa(i)))
+			}
+
+			buffer := new(bytes.Buffer)
+			if err := dumpFilter(buffer, f); err != nil {
+				t.Errorf("dump error: %v", err)
+				continue
+			}
+			loaded, err := loadFilter(buffer)
+			if err != nil {
+				t.Errorf("load error: %v", err)
+				continue
+			}
+
+			expected := hash
+			if expected == "" {
+				expected = HASH_FNV64
+			}
+			if HashOf(loaded) != expected {
+				t.Errorf("%s filter hash expected %s, got %s", typ, expected, HashOf(loaded))
+			}
+
+			false_positives := 0
+			for i := 0; i < 1000; i++ {
+				if !loaded.Test([]byte(strconv.Itoa(i))) {
+					t.Errorf("%s filter with hash %s lost key %d", typ, hash, i)
+					break
+				}
+				if loaded.Test([]byte(strconv.Itoa(i + 1000))) {
+					false_positives++
+				}
+			}
+			if false_positives > 50 {
+				t.Errorf("%s filter with hash %s has too many false positives: %d", typ, hash, false_positives)
+			}
+		}
+	}
+
+	if _, err := NewClassicBloomFilter(FilterOptions{Name: "test", ErrorRate: 0.01, N: 1000, Hash: "md5"}); err == nil {
+		t.Errorf("unknown hash should fail")
+	}
+}
+
+// Ensures that fnv64 keeps locations of filters before hash was pluggable.
+func TestFnvLocations(t *testing.T) {
+	m := uint(958505)
+	for _, key := range []string{"a", "wreathed", "12345"} {
+		lower, upper := hashKernel([]byte(key))
+		h1, h2 := hashKeys(HASH_KIND_FNV64, []byte(key))
+		for i := uint(0); i < 7; i++ {
+			if location(h1, h2, i, m) != (uint(lower)+uint(upper)*i)%m {
+				t.Errorf("fnv64 location %d of %s changed", i, key)
+			}
+		}
+	}
+}
+
+func benchmarkHash(b *testing.B, kind byte) {
+	data := bytes.Repeat([]byte("x"), 256)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		hashKeys(kind, data)
+	}
+}
+
+func BenchmarkHashFnv64(b *testing.B)   { benchmarkHash(b, HASH_KIND_FNV64) }
+func BenchmarkHashMurmur3(b *testing.B) { benchmarkHash(b, HASH_KIND_MURMUR3) }
+func BenchmarkHashXxhash(b *testing.B)  { benchmarkHash(b, HASH_KIND_XXHASH) }
@@ -0,0 +1,472 @@
+package bloom
+
+/*
+ *  @Describe: loading of gob dumps before the binary format
+ *
+ *  version 0 dumps are a gob DumpHeader followed by the gob encoded filter,
+ *  optionally gzip compressed. version 1 dumps frame the body by chunks as
+ *  [len uint32][data], terminated by a zero length chunk followed by crc32
+ *  (IEEE) of all data.
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/alecthomas/log4go"
+)
+
+func loadLegacyFilter(reader io.Reader) (Filter, *DumpHeader, error) {
+	dumpHeader := DumpHeader{}
+
+	dec := gob.NewDecoder(reader)
+	if err := dec.Decode(&dumpHeader); err != nil {
+		log4go.Warn("read dump header error : %v", err)
+		return nil, nil, ILLEGAL_LOAD_FORMAT
+	}
+	if dumpHeader.Magic != MAGIC_NUM {
+		log4go.Warn("mismatch magic number")
+		return nil, nil, ILLEGAL_LOAD_FORMAT
+	}
+	if dumpHeader.Version > DUMP_VERSION_CHECKSUM {
+		log4go.Warn("unsupported dump version %d", dumpHeader.Version)
+		return nil, &dumpHeader, ILLEGAL_LOAD_FORMAT
+	}
+	log4go.Trace("loaded header %+v", dumpHeader)
+
+	var checksum *checksumReader
+	if dumpHeader.Version >= DUMP_VERSION_CHECKSUM {
+		checksum = newChecksumReader(reader)
+		// decoders of filter share the reader, it must not be read ahead
+		reader = bufio.NewReader(checksum)
+	}
+
+	if dumpHeader.FilterUsedGzip {
+		var err error
+		reader, err = gzip.NewReader(reader)
+		if err != nil {
+			log4go.Warn("decompress error: %v", err)
+			return nil, &dumpHeader, err
+		}
+
+		reader = bufio.NewReader(reader)
+	}
+
+	filter, err := loadLegacyFilterBody(dumpHeader.FilterType, reader)
+	if err != nil {
+		return nil, &dumpHeader, err
+	}
+
+	if checksum != nil {
+		if err := checksum.Verify(); err != nil {
+			log4go.Warn("verify %s filter %s error: %v", dumpHeader.FilterType, filter.Name(), err)
+			return nil, &dumpHeader, err
+		}
+	}
+
+	return filter, &dumpHeader, nil
+}
+
+func loadLegacyFilterBody(t string, reader io.Reader) (Filter, error) {
+	switch t {
+	case FILTER_CLASSIC:
+		f := &ClassicBloomFilter{}
+		if err := f.loadGob(reader); err != nil {
+			log4go.Warn("classic fiter load error:%v", err)
+			return nil, err
+		}
+
+		return f, nil
+	case FILTER_ROTATED:
+		f := &RotatedBloomFilter{}
+		if err := f.loadGob(reader); err != nil {
+			return nil, err
+		}
+
+		return f, nil
+	case FILTER_COUNTING:
+		f := &CountingBloomFilter{}
+		if err := f.loadGob(reader); err != nil {
+			log4go.Warn("counting fiter load error:%v", err)
+			return nil, err
+		}
+
+		return f, nil
+	case FILTER_SCALABLE:
+		f := &ScalableBloomFilter{}
+		if err := f.loadGob(reader); err != nil {
+			return nil, err
+		}
+
+		return f, nil
+	default:
+		log4go.Warn("unknown filter type :%v", t)
+		return nil, ILLEGAL_LOAD_FORMAT
+	}
+}
+
+type BucketsDump struct {
+	Data  []byte
+	Max   uint8
+	Size  uint8
+	Count uint
+}
+
+func (b *Buckets) loadGob(stream io.Reader) error {
+	d := &BucketsDump{}
+	dec := gob.NewDecoder(stream)
+	if err := dec.Decode(d); err != nil {
+		log4go.Info("load bucket error: %+v", err)
+		return err
+	}
+
+	b.max = d.Max
+	b.data = d.Data
+	b.bucketSize = d.Size
+	b.count = d.Count
+
+	return nil
+}
+
+type ClassicBloomFilterDumpHeader struct {
+	Name      string
+	M         uint
+	K         uint
+	Count     uint
+	ErrorRate float64
+}
+
+func (b *ClassicBloomFilter) loadGob(stream io.Reader) error {
+	dec := gob.NewDecoder(stream)
+	header := ClassicBloomFilterDumpHeader{}
+	err := dec.Decode(&header)
+	if err != nil {
+		log4go.Warn("read class bloom filter header error")
+		return err
+	}
+
+	b.name = header.Name
+	b.k = header.K
+	b.m = header.M
+	b.count = uint64(header.Count)
+	b.errorRate = header.ErrorRate
+	log4go.Info("loaded classic filter name:%s k:%d m:%d count:%d", b.name, b.k, b.m, b.count)
+
+	buckets := NewBuckets(b.m, 1)
+	if err := buckets.loadGob(stream); err != nil {
+		return err
+	}
+	if buckets.bucketSize != 1 || buckets.Count() != b.m {
+		log4go.Warn("illegal buckets of classic filter, size:%d count:%d", buckets.bucketSize, buckets.Count())
+		return ILLEGAL_LOAD_FORMAT
+	}
+
+	b.bits = newBitsetOfBytes(b.m, buckets.data)
+	return nil
+}
+
+type CountingBloomFilterDumpHeader struct {
+	Name       string
+	M          uint
+	K          uint
+	Count      uint
+	ErrorRate  float64
+	BucketSize uint8
+}
+
+func (b *CountingBloomFilter) loadGob(stream io.Reader) error {
+	dec := gob.NewDecoder(stream)
+	header := CountingBloomFilterDumpHeader{}
+	err := dec.Decode(&header)
+	if err != nil {
+		log4go.Warn("read counting bloom filter header error")
+		return err
+	}
+
+	b.name = header.Name
+	b.k = header.K
+	b.m = header.M
+	b.count = header.Count
+	b.errorRate = header.ErrorRate
+	b.bucketSize = header.BucketSize
+	b.buckets = NewBuckets(b.m, b.bucketSize)
+	log4go.Info("loaded counting filter name:%s k:%d m:%d count:%d", b.name, b.k, b.m, b.count)
+
+	return b.buckets.loadGob(stream)
+}
+
+type RotatedBloomFilterHeader struct {
+	R       uint
+	Current uint
+	Name    string
+
+	RotatedInterval time.Duration
+	LastRotated     time.Time
+}
+
+type RotatedBloomFilterChunk struct {
+	BodyLen int32
+	Data    []byte
+}
+
+func (b *RotatedBloomFilter) loadGob(r io.Reader) error {
+	b.RLock()
+	defer b.RUnlock()
+	dec := gob.NewDecoder(r)
+
+	header := RotatedBloomFilterHeader{}
+	if err := dec.Decode(&header); err != nil {
+		log4go.Warn("load header error: %v", err)
+		return ILLEGAL_LOAD_FORMAT
+	}
+
+	b.r = header.R
+	if b.r == 0 {
+		log4go.Warn("suspicous filter, r is zero")
+		return ILLEGAL_LOAD_FORMAT
+	}
+
+	b.current = header.Current
+	b.name = header.Name
+	b.lastRotated = header.LastRotated
+	b.rotateInterval = header.RotatedInterval
+
+	b.innerFilters = make([]Filter, 0)
+
+	for i := uint(0); i < b.r; i++ {
+		chunk := RotatedBloomFilterChunk{}
+		if err := dec.Decode(&chunk); err != nil {
+			log4go.Warn("get chunk of %d error: %v", i, err)
+			return ILLEGAL_LOAD_FORMAT
+		}
+
+		if len(chunk.Data) != int(chunk.BodyLen) {
+			log4go.Warn("chunk %d len %d not equal to data len %d", chunk.BodyLen, len(chunk.Data))
+		}
+		if filter, err := loadFilter(bytes.NewBuffer(chunk.Data)); err != nil {
+			log4go.Warn("load filter error: %v", err)
+			return ILLEGAL_LOAD_FORMAT
+		} else {
+			b.innerFilters = append(b.innerFilters, filter)
+		}
+	}
+
+	log4go.Info("load rotated filter, name:%s current:%d r:%d last_rotated:%+v rotated_interval:%+v next_interval_time:%+v",
+		b.name, b.current, b.r, b.lastRotated, b.rotateInterval, b.lastRotated.Add(b.rotateInterval))
+	return nil
+}
+
+type ScalableBloomFilterHeader struct {
+	Name      string
+	N         uint
+	ErrorRate float64
+	Stages    uint
+}
+
+type ScalableBloomFilterChunk struct {
+	Stage   uint
+	BodyLen int32
+	Data    []byte
+}
+
+func (b *ScalableBloomFilter) loadGob(r io.Reader) error {
+	b.Lock()
+	defer b.Unlock()
+	dec := gob.NewDecoder(r)
+
+	header := ScalableBloomFilterHeader{}
+	if err := dec.Decode(&header); err != nil {
+		log4go.Warn("load header error: %v", err)
+		return ILLEGAL_LOAD_FORMAT
+	}
+
+	if header.Stages == 0 {
+		log4go.Warn("suspicous filter, stages is zero")
+		return ILLEGAL_LOAD_FORMAT
+	}
+
+	b.name = header.Name
+	b.n = header.N
+	b.errorRate = header.ErrorRate
+	b.stages = make([]Filter, 0)
+
+	for i := uint(0); i < header.Stages; i++ {
+		chunk := ScalableBloomFilterChunk{}
+		if err := dec.Decode(&chunk); err != nil {
+			log4go.Warn("get chunk of %d error: %v", i, err)
+			return ILLEGAL_LOAD_FORMAT
+		}
+
+		if chunk.Stage != i || len(chunk.Data) != int(chunk.BodyLen) {
+			log4go.Warn("chunk %d stage %d len %d not equal to data len %d", i, chunk.Stage, chunk.BodyLen, len(chunk.Data))
+			return ILLEGAL_LOAD_FORMAT
+		}
+
+		if filter, err := loadFilter(bytes.NewBuffer(chunk.Data)); err != nil {
+			log4go.Warn("load filter error: %v", err)
+			return ILLEGAL_LOAD_FORMAT
+		} else {
+			b.stages = append(b.stages, filter)
+		}
+	}
+
+	log4go.Info("load scalable filter, name:%s n:%d error_rate:%v stages:%d", b.name, b.n, b.errorRate, len(b.stages))
+	return nil
+}
+
+const (
+	CHECKSUM_CHUNK_SIZE = 64 * 1024
+)
+
+type checksumWriter struct {
+	w   io.Writer
+	buf []byte
+	crc hash.Hash32
+}
+
+func newChecksumWriter(w io.Writer) *checksumWriter {
+	return &checksumWriter{
+		w:   w,
+		buf: make([]byte, 0, CHECKSUM_CHUNK_SIZE),
+		crc: crc32.NewIEEE(),
+	}
+}
+
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(c.buf[len(c.buf):cap(c.buf)], p)
+		c.buf = c.buf[:len(c.buf)+n]
+		p = p[n:]
+		written += n
+
+		if len(c.buf) == cap(c.buf) {
+			if err := c.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+func (c *checksumWriter) flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(c.buf)))
+	if _, err := c.w.Write(size[:]); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(c.buf); err != nil {
+		return err
+	}
+
+	c.crc.Write(c.buf)
+	c.buf = c.buf[:0]
+	return nil
+}
+
+// Close writes the terminating chunk and checksum, the underlying writer is not closed
+func (c *checksumWriter) Close() error {
+	if err := c.flush(); err != nil {
+		return err
+	}
+
+	var trailer [8]byte
+	binary.BigEndian.PutUint32(trailer[4:], c.crc.Sum32())
+	_, err := c.w.Write(trailer[:])
+	return err
+}
+
+type checksumReader struct {
+	r    io.Reader
+	left uint32 // bytes left in current chunk
+	crc  hash.Hash32
+	done bool
+	err  error
+}
+
+func newChecksumReader(r io.Reader) *checksumReader {
+	return &checksumReader{
+		r:   r,
+		crc: crc32.NewIEEE(),
+	}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	if c.left == 0 {
+		if err := c.nextChunk(); err != nil {
+			c.err = err
+			return 0, err
+		}
+	}
+
+	if uint32(len(p)) > c.left {
+		p = p[:c.left]
+	}
+
+	n, err := c.r.Read(p)
+	c.crc.Write(p[:n])
+	c.left -= uint32(n)
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		c.err = err
+	}
+
+	return n, err
+}
+
+func (c *checksumReader) nextChunk() error {
+	var size [4]byte
+	if _, err := io.ReadFull(c.r, size[:]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+
+	c.left = binary.BigEndian.Uint32(size[:])
+	if c.left > 0 {
+		return nil
+	}
+
+	var sum [4]byte
+	if _, err := io.ReadFull(c.r, sum[:]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+
+	c.done = true
+	if binary.BigEndian.Uint32(sum[:]) != c.crc.Sum32() {
+		return CHECKSUM_ERROR
+	}
+
+	return io.EOF
+}
+
+// Verify consumes the rest of body and checks the checksum
+func (c *checksumReader) Verify() error {
+	if _, err := io.Copy(ioutil.Discard, c); err != nil {
+		return err
+	}
+
+	if !c.done {
+		return io.ErrUnexpectedEOF
+	}
+
+	return nil
+}
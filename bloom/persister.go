@@ -5,54 +5,247 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/alecthomas/log4go"
 )
 
+const (
+	TMP_SUFFIX = ".tmp"
+)
+
 type FilterPersister interface {
 	ListFilterNames() ([]string, error)
 	NewWriter(filterName string) (Writer, error)
 	NewReader(filterName string) (*bufio.Reader, io.Closer, error)
+	Remove(filterName string) error
+
+	// OpenLog returns the add log of filter, nil if not supported
+	OpenLog(filterName string) (*AddLog, error)
+
+	// history snapshots, newest first
+	ListSnapshots(filterName string) ([]Snapshot, error)
+	NewSnapshotReader(filterName string, timestamp int64) (*bufio.Reader, io.Closer, error)
+}
+
+type Snapshot struct {
+	Timestamp int64 // unix timestamp the snapshot dumped
+	Size      int64
+	Current   bool // the one loaded when recovering
+}
+
+// RetentionPolicy decides which history snapshots are kept after dump,
+// zero means no limit, the current snapshot is always kept
+type RetentionPolicy struct {
+	Keep   int
+	MaxAge time.Duration
 }
 
+// Writer writes a snapshot of filter, the snapshot only replaces the current
+// one after Close succeeded, Abort drops it
 type Writer interface {
 	Write([]byte) (int, error)
 	Close() error
+	Abort() error
+}
+
+// LoggedWriter is a Writer of filter with add log, keys of segments before
+// LogStart are in the snapshot, so only later ones are replayed over it
+type LoggedWriter interface {
+	Writer
+
+	LogStart() int64
+
+	// Hold rolls the log again and blocks logged adds till the writer is
+	// closed or aborted, so keys of segments from LogStart aren't in the
+	// snapshot either, for filters whose adds aren't idempotent
+	Hold() error
 }
 
 type fileWriter struct {
 	f *os.File
+	w *bufio.Writer
+	p *LocalFileFilterPersister
+
+	log    *AddLog // rolled log, purged after dump succeeded
+	logSeq int64
+	held   bool // appends to log are blocked by Hold
+	failed bool
+
+	dumping *sync.Mutex // of the filter, released once closed or aborted
+	release sync.Once
 
 	basePath string
 	baseName string
 	fullpath string
+	tmppath  string
 }
 
 type LocalFileFilterPersister struct {
-	basePath string
-	useGzip  bool
+	sync.Mutex
+
+	basePath  string
+	useGzip   bool
+	logs      map[string]*AddLog
+	retention RetentionPolicy
+
+	// dumps of a filter are serialized, as ones in the same second share
+	// paths, and a later roll of log must not be purged by an older dump
+	dumping map[string]*sync.Mutex
 }
 
 func (fw *fileWriter) Write(b []byte) (int, error) {
-	bytes, err := fw.f.Write(b)
+	bytes, err := fw.w.Write(b)
+	if err != nil {
+		fw.failed = true
+	}
 	return bytes, err
 }
 
+// Close flushes the snapshot to disk, validates it, then swaps the link to it
 func (fw *fileWriter) Close() error {
-	fw.f.Close()
+	defer fw.done()
+
+	if fw.failed {
+		fw.Abort()
+		return fmt.Errorf("write snapshot %s error", fw.tmppath)
+	}
+
+	if err := fw.sync(); err != nil {
+		log4go.Warn("sync snapshot %s error: %v", fw.tmppath, err)
+		fw.Abort()
+		return err
+	}
+
+	if err := checkFile(fw.tmppath); err != nil {
+		log4go.Warn("check snapshot %s error: %v", fw.tmppath, err)
+		fw.Abort()
+		return err
+	}
+
+	if err := os.Rename(fw.tmppath, fw.fullpath); err != nil {
+		log4go.Warn("rename %s to %s error: %v", fw.tmppath, fw.fullpath, err)
+		fw.Abort()
+		return err
+	}
 
 	linkName := filepath.Join(fw.basePath, fw.baseName)
+	tmpLinkName := linkName + TMP_SUFFIX
 
-	os.Remove(linkName)
+	os.Remove(tmpLinkName)
+	if err := os.Symlink(fw.fullpath, tmpLinkName); err != nil {
+		log4go.Warn("create link %s error: %v", tmpLinkName, err)
+		return err
+	}
+	if err := os.Rename(tmpLinkName, linkName); err != nil {
+		log4go.Warn("rename link %s error: %v", tmpLinkName, err)
+		os.Remove(tmpLinkName)
+		return err
+	}
 	log4go.Info("create link %s => %s", linkName, fw.fullpath)
-	return os.Symlink(fw.fullpath, linkName)
+
+	if err := syncDir(fw.basePath); err != nil {
+		log4go.Warn("sync dir %s error: %v", fw.basePath, err)
+		return err
+	}
+
+	if err := fw.p.collectSnapshots(fw.baseName); err != nil {
+		log4go.Warn("collect snapshots of %s error: %v", fw.baseName, err)
+	}
+
+	if fw.log != nil {
+		return fw.log.Purge(fw.logSeq)
+	}
+
+	return nil
+}
+
+// Abort drops the snapshot, current link and logs are kept
+func (fw *fileWriter) Abort() error {
+	defer fw.done()
+
+	fw.f.Close()
+	log4go.Warn("abort snapshot %s", fw.tmppath)
+
+	return os.Remove(fw.tmppath)
+}
+
+func (fw *fileWriter) LogStart() int64 {
+	if fw.log == nil {
+		return 0
+	}
+
+	return fw.logSeq + 1
+}
+
+func (fw *fileWriter) Hold() error {
+	if fw.log == nil || fw.held {
+		return nil
+	}
+
+	seq, err := fw.log.Hold()
+	if err != nil {
+		log4go.Warn("hold log of %s error: %v", fw.baseName, err)
+		return err
+	}
+
+	fw.logSeq = seq
+	fw.held = true
+	return nil
+}
+
+// done lets logged adds and the next dump of the filter go on
+func (fw *fileWriter) done() {
+	fw.release.Do(func() {
+		if fw.held {
+			fw.log.Unlock()
+		}
+		fw.dumping.Unlock()
+	})
+}
+
+func (fw *fileWriter) sync() error {
+	if err := fw.w.Flush(); err != nil {
+		fw.f.Close()
+		return err
+	}
+
+	if err := fw.f.Sync(); err != nil {
+		fw.f.Close()
+		return err
+	}
+
+	return fw.f.Close()
+}
+
+func checkFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return CheckFilter(bufio.NewReader(f))
 }
 
-func NewLocalFileFilterPersister(path string) (FilterPersister, error) {
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+func NewLocalFileFilterPersister(path string, retention RetentionPolicy) (FilterPersister, error) {
 	fs, err := os.Stat(path)
 	if err != nil {
 		return nil, fmt.Errorf("open path error")
@@ -61,7 +254,12 @@ func NewLocalFileFilterPersister(path string) (FilterPersister, error) {
 		return nil, fmt.Errorf("path is not dir error")
 	}
 
-	return &LocalFileFilterPersister{basePath: path}, nil
+	return &LocalFileFilterPersister{
+		basePath:  path,
+		logs:      make(map[string]*AddLog),
+		retention: retention,
+		dumping:   make(map[string]*sync.Mutex),
+	}, nil
 }
 
 func (p *LocalFileFilterPersister) ListFilterNames() ([]string, error) {
@@ -74,7 +272,7 @@ func (p *LocalFileFilterPersister) ListFilterNames() ([]string, error) {
 	}
 
 	for _, file := range files {
-		if 0 != (file.Mode() & os.ModeSymlink) {
+		if 0 != (file.Mode()&os.ModeSymlink) && !strings.HasSuffix(file.Name(), TMP_SUFFIX) {
 			ret = append(ret, file.Name())
 		}
 	}
@@ -84,18 +282,48 @@ func (p *LocalFileFilterPersister) ListFilterNames() ([]string, error) {
 	return ret, nil
 }
 
+// NewWriter waits for the running dump of name to be closed or aborted
 func (p *LocalFileFilterPersister) NewWriter(name string) (Writer, error) {
+	p.Lock()
+	dumping, ok := p.dumping[name]
+	if !ok {
+		dumping = new(sync.Mutex)
+		p.dumping[name] = dumping
+	}
+	p.Unlock()
+
+	dumping.Lock()
+
 	fullpath := filepath.Join(p.basePath, name+"."+strconv.FormatInt(time.Now().Unix(), 10))
-	if f, err := os.OpenFile(fullpath, os.O_WRONLY|os.O_CREATE, os.ModePerm); err != nil {
-		log4go.Info("get writer from %s error :%v", fullpath, err)
+	tmppath := fullpath + TMP_SUFFIX
+	if f, err := os.OpenFile(tmppath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm); err != nil {
+		log4go.Info("get writer from %s error :%v", tmppath, err)
+		dumping.Unlock()
 		return nil, err
 	} else {
 		w := &fileWriter{
 			f:        f,
+			w:        bufio.NewWriter(f),
+			p:        p,
+			dumping:  dumping,
 			basePath: p.basePath,
 			baseName: name,
 			fullpath: fullpath,
+			tmppath:  tmppath,
 		}
+
+		p.Lock()
+		w.log = p.logs[name]
+		p.Unlock()
+
+		if w.log != nil {
+			// keys logged after roll may miss in this dump, keep them
+			if w.logSeq, err = w.log.Roll(); err != nil {
+				log4go.Warn("roll log of %s error: %v", name, err)
+				w.log = nil
+			}
+		}
+
 		return w, nil
 	}
 }
@@ -112,3 +340,153 @@ func (p *LocalFileFilterPersister) NewReader(name string) (*bufio.Reader, io.Clo
 		return bufio.NewReader(f), f, nil
 	}
 }
+
+func (p *LocalFileFilterPersister) snapshotPath(name string, timestamp int64) string {
+	return filepath.Join(p.basePath, name+"."+strconv.FormatInt(timestamp, 10))
+}
+
+func (p *LocalFileFilterPersister) ListSnapshots(name string) ([]Snapshot, error) {
+	files, err := ioutil.ReadDir(p.basePath)
+	if err != nil {
+		log4go.Warn("read dir of %s error:%v", p.basePath, err)
+		return nil, err
+	}
+
+	current := ""
+	if target, err := os.Readlink(filepath.Join(p.basePath, name)); err == nil {
+		current = filepath.Base(target)
+	}
+
+	ret := make([]Snapshot, 0)
+	for _, file := range files {
+		// links are current snapshots of filters, name.7 may be another one
+		if 0 != (file.Mode()&os.ModeSymlink) || !isDumpFileOf(name, file.Name()) || strings.HasSuffix(file.Name(), TMP_SUFFIX) {
+			continue
+		}
+
+		timestamp, _ := strconv.ParseInt(file.Name()[len(name)+1:], 10, 64)
+		ret = append(ret, Snapshot{
+			Timestamp: timestamp,
+			Size:      file.Size(),
+			Current:   file.Name() == current,
+		})
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Timestamp > ret[j].Timestamp })
+	return ret, nil
+}
+
+func (p *LocalFileFilterPersister) NewSnapshotReader(name string, timestamp int64) (*bufio.Reader, io.Closer, error) {
+	fullpath := p.snapshotPath(name, timestamp)
+
+	if f, err := os.Open(fullpath); err != nil {
+		log4go.Warn("get reader from %s error :%v", fullpath, err)
+		return nil, nil, err
+	} else {
+		log4go.Trace("got reader of %s from %s", name, fullpath)
+
+		return bufio.NewReader(f), f, nil
+	}
+}
+
+// collectSnapshots removes snapshots out of retention
+func (p *LocalFileFilterPersister) collectSnapshots(name string) error {
+	if p.retention.Keep <= 0 && p.retention.MaxAge <= 0 {
+		return nil
+	}
+
+	snapshots, err := p.ListSnapshots(name)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i, snapshot := range snapshots {
+		if snapshot.Current {
+			continue
+		}
+
+		expired := p.retention.MaxAge > 0 && now.Sub(time.Unix(snapshot.Timestamp, 0)) > p.retention.MaxAge
+		if (p.retention.Keep > 0 && i >= p.retention.Keep) || expired {
+			fullpath := p.snapshotPath(name, snapshot.Timestamp)
+			if err := os.Remove(fullpath); err != nil {
+				return err
+			}
+			log4go.Info("removed snapshot %s", fullpath)
+		}
+	}
+
+	return nil
+}
+
+func (p *LocalFileFilterPersister) OpenLog(name string) (*AddLog, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if l, ok := p.logs[name]; ok {
+		return l, nil
+	}
+
+	l, err := OpenAddLog(p.basePath, name)
+	if err != nil {
+		return nil, err
+	}
+
+	p.logs[name] = l
+	return l, nil
+}
+
+func (p *LocalFileFilterPersister) Remove(name string) error {
+	p.Lock()
+	l, ok := p.logs[name]
+	delete(p.logs, name)
+	p.Unlock()
+
+	if !ok {
+		l = &AddLog{basePath: p.basePath, name: name, seq: math.MaxInt64}
+	}
+	if err := l.Destroy(); err != nil {
+		log4go.Warn("remove log of %s error: %v", name, err)
+		return err
+	}
+
+	linkName := filepath.Join(p.basePath, name)
+	if err := os.Remove(linkName); err != nil && !os.IsNotExist(err) {
+		log4go.Warn("remove link %s error: %v", linkName, err)
+		return err
+	}
+	os.Remove(linkName + TMP_SUFFIX)
+
+	files, err := ioutil.ReadDir(p.basePath)
+	if err != nil {
+		log4go.Warn("read dir of %s error:%v", p.basePath, err)
+		return err
+	}
+
+	for _, file := range files {
+		// link of another filter may look like a dump, e.g. name.7
+		if 0 != (file.Mode()&os.ModeSymlink) || !isDumpFileOf(name, file.Name()) {
+			continue
+		}
+
+		fullpath := filepath.Join(p.basePath, file.Name())
+		if err := os.Remove(fullpath); err != nil {
+			log4go.Warn("remove dump file %s error: %v", fullpath, err)
+			return err
+		}
+		log4go.Info("removed dump file %s", fullpath)
+	}
+
+	return nil
+}
+
+// dump files are named as name.<unix timestamp>, with TMP_SUFFIX while writing
+func isDumpFileOf(name, fileName string) bool {
+	fileName = strings.TrimSuffix(fileName, TMP_SUFFIX)
+	if len(fileName) <= len(name)+1 || fileName[:len(name)+1] != name+"." {
+		return false
+	}
+
+	_, err := strconv.ParseInt(fileName[len(name)+1:], 10, 64)
+	return err == nil
+}
@@ -0,0 +1,372 @@
+package bloom
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLocalFilePersisterRemove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bfserver")
+	if err != nil {
+		t.Errorf("create temp dir error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"test.1", "test.2", "test.bak", "test2.1", "test.7.1", "other.1"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte{}, 0644)
+	}
+	os.Symlink(filepath.Join(dir, "test.2"), filepath.Join(dir, "test"))
+	os.Symlink(filepath.Join(dir, "test2.1"), filepath.Join(dir, "test2"))
+	os.Symlink(filepath.Join(dir, "test.7.1"), filepath.Join(dir, "test.7"))
+
+	p, _ := NewLocalFileFilterPersister(dir, RetentionPolicy{})
+	if err := p.Remove("test"); err != nil {
+		t.Errorf("remove error: %v", err)
+		return
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	left := make(map[string]bool)
+	for _, file := range files {
+		left[file.Name()] = true
+	}
+
+	for _, name := range []string{"test", "test.1", "test.2"} {
+		if left[name] {
+			t.Errorf("%s should be removed", name)
+		}
+	}
+	for _, name := range []string{"test.bak", "test2", "test2.1", "test.7", "test.7.1", "other.1"} {
+		if !left[name] {
+			t.Errorf("%s should not be removed", name)
+		}
+	}
+}
+
+func TestManagerDeleteFilter(t *testing.T) {
+	m, _ := NewFilterManager(&TestPersister{}, 6000)
+	m.AddNewBloomFilter(FILTER_CLASSIC, FilterOptions{Name: "a", N: 100, ErrorRate: 0.1})
+	m.AddNewBloomFilter(FILTER_COUNTING, FilterOptions{Name: "b", N: 100, ErrorRate: 0.1})
+
+	if err := m.DeleteFilter("a"); err != nil {
+		t.Errorf("delete filter error: %v", err)
+	}
+	if err := m.DeleteFilter("a"); err == nil {
+		t.Errorf("delete non exists filter should fail")
+	}
+
+	filters := m.ListFilters()
+	if len(filters) != 1 || filters[0].Name != "b" || filters[0].Type != FILTER_COUNTING {
+		t.Errorf("list filters error: %+v", filters)
+	}
+}
+
+// Ensures that cached infos read cheap fields of current filters now and fill
+// ratios of the last refresh.
+func TestManagerCachedFilterInfos(t *testing.T) {
+	m, _ := NewFilterManager(&TestPersister{}, 6000)
+	m.AddNewBloomFilter(FILTER_COUNTING, FilterOptions{Name: "b", N: 100, ErrorRate: 0.1})
+	m.AddNewBloomFilter(FILTER_CLASSIC, FilterOptions{Name: "a", N: 100, ErrorRate: 0.1})
+
+	a, _ := m.GetBloomFilter("a")
+	a.Add([]byte("x"))
+	m.refreshInfos()
+	fillRatio := a.FillRatio()
+	a.Add([]byte("y"))
+	m.AddNewBloomFilter(FILTER_CLASSIC, FilterOptions{Name: "c", N: 100, ErrorRate: 0.1})
+	m.DeleteFilter("b")
+
+	infos := m.CachedFilterInfos()
+	if len(infos) != 2 || infos[0].Name != "a" || infos[1].Name != "c" {
+		t.Errorf("infos should be of current filters: %+v", infos)
+		return
+	}
+	if infos[0].Count != 2 || infos[0].FillRatio != fillRatio {
+		t.Errorf("count should be current and fill ratio of last refresh: %+v", infos[0])
+	}
+	if infos[1].Type != FILTER_CLASSIC || infos[1].Capacity == 0 || infos[1].FillRatio != 0 {
+		t.Errorf("filter created since refresh should have brief info: %+v", infos[1])
+	}
+}
+
+// Ensures that nothing is merged if any source is missing or incompatible.
+func TestManagerMergeFiltersChecked(t *testing.T) {
+	m, _ := NewFilterManager(&TestPersister{}, 6000)
+	a, _ := m.AddNewBloomFilter(FILTER_CLASSIC, FilterOptions{Name: "a", N: 100, ErrorRate: 0.1})
+	b, _ := m.AddNewBloomFilter(FILTER_CLASSIC, FilterOptions{Name: "b", N: 100, ErrorRate: 0.1})
+	m.AddNewBloomFilter(FILTER_CLASSIC, FilterOptions{Name: "c", N: 1000, ErrorRate: 0.1})
+	m.AddNewBloomFilter(FILTER_COUNTING, FilterOptions{Name: "d", N: 100, ErrorRate: 0.1})
+	b.Add([]byte("x"))
+
+	for _, sources := range [][]string{{"b", "missing"}, {"b", "c"}, {"b", "d"}} {
+		if err := m.MergeFilters("a", sources, MERGE_UNION); err == nil {
+			t.Errorf("merge of %v should fail", sources)
+		}
+		if a.Test([]byte("x")) {
+			t.Errorf("nothing should be merged by failed merge of %v", sources)
+		}
+	}
+
+	if err := m.MergeFilters("a", []string{"b"}, MERGE_UNION); err != nil || !a.Test([]byte("x")) {
+		t.Errorf("merge error: %v", err)
+	}
+}
+
+// Ensures that dumps of a deleted filter, started before or after the
+// delete, never recreate its files.
+func TestManagerDeleteFilterDumping(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bfserver")
+	if err != nil {
+		t.Errorf("create temp dir error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	p, _ := NewLocalFileFilterPersister(dir, RetentionPolicy{})
+	m, _ := NewFilterManager(p, 6000)
+	f, _ := m.AddNewBloomFilter(FILTER_CLASSIC, FilterOptions{Name: "a", N: 100, ErrorRate: 0.1})
+
+	w, _ := m.persisterOf(f).NewWriter("a")
+	dumpFilter(w, f)
+
+	m.DeleteFilter("a")
+	if err := w.Close(); err != FILTER_DELETED_ERROR {
+		t.Errorf("dump started before delete should fail, got %v", err)
+	}
+	if err := persistFilter(m.persisterOf(f), f); err != FILTER_DELETED_ERROR {
+		t.Errorf("dump started after delete should fail, got %v", err)
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("files of deleted filter left: %d", len(files))
+	}
+
+	// the filter created again under the name dumps as usual
+	g, _ := m.AddNewBloomFilter(FILTER_CLASSIC, FilterOptions{Name: "a", N: 100, ErrorRate: 0.1})
+	if err := persistFilter(m.persisterOf(g), g); err != nil {
+		t.Errorf("dump of new filter error: %v", err)
+	}
+}
+
+// Ensures that a dump of another filter isn't reloaded, so dumps of the
+// filter go on.
+func TestManagerReloadOtherFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bfserver")
+	if err != nil {
+		t.Errorf("create temp dir error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	p, _ := NewLocalFileFilterPersister(dir, RetentionPolicy{})
+	m, _ := NewFilterManager(p, 6000)
+	a, _ := m.AddNewBloomFilter(FILTER_CLASSIC, FilterOptions{Name: "a", N: 100, ErrorRate: 0.1})
+	b, _ := NewClassicBloomFilter(FilterOptions{Name: "b", N: 100, ErrorRate: 0.1})
+	persistFilter(p, b)
+
+	if err := m.ReloadFilter("a", filepath.Join(dir, "b")); err == nil {
+		t.Errorf("reload dump of b as a should fail")
+	}
+	if f, _ := m.GetBloomFilter("a"); f != a {
+		t.Errorf("filter a should be kept")
+	}
+	if err := persistFilter(m.persisterOf(a), a); err != nil {
+		t.Errorf("dump of a error: %v", err)
+	}
+}
+
+func TestLocalFilePersisterWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bfserver")
+	if err != nil {
+		t.Errorf("create temp dir error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	p, _ := NewLocalFileFilterPersister(dir, RetentionPolicy{})
+	f, _ := NewClassicBloomFilter(FilterOptions{Name: "test", N: 100, ErrorRate: 0.1})
+	f.Add([]byte("a"))
+
+	if err := persistFilter(p, f); err != nil {
+		t.Errorf("persist filter error: %v", err)
+		return
+	}
+
+	target, err := os.Readlink(filepath.Join(dir, "test"))
+	if err != nil {
+		t.Errorf("read link error: %v", err)
+		return
+	}
+
+	// a broken snapshot never replaces the good one
+	w, _ := p.NewWriter("test")
+	w.Write([]byte("broken"))
+	if err := w.Close(); err == nil {
+		t.Errorf("close broken snapshot should fail")
+	}
+
+	w, _ = p.NewWriter("test")
+	w.Write([]byte("aborted"))
+	w.Abort()
+
+	if now, _ := os.Readlink(filepath.Join(dir, "test")); now != target {
+		t.Errorf("link changed to %s", now)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	for _, file := range files {
+		if filepath.Ext(file.Name()) == TMP_SUFFIX {
+			t.Errorf("temp file %s left", file.Name())
+		}
+	}
+
+	names, _ := p.ListFilterNames()
+	if len(names) != 1 || names[0] != "test" {
+		t.Errorf("list filter names error: %v", names)
+	}
+
+	reader, closer, err := p.NewReader("test")
+	if err != nil {
+		t.Errorf("new reader error: %v", err)
+		return
+	}
+	defer closer.Close()
+
+	loaded, err := loadFilter(reader)
+	if err != nil || !loaded.Test([]byte("a")) {
+		t.Errorf("load persisted filter error: %v", err)
+	}
+}
+
+func TestLocalFilePersisterRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bfserver")
+	if err != nil {
+		t.Errorf("create temp dir error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now().Unix()
+	for _, ts := range []int64{now - 10, now - 20, now - 30, now - 7200} {
+		ioutil.WriteFile(filepath.Join(dir, "test."+strconv.FormatInt(ts, 10)), []byte{}, 0644)
+	}
+
+	p, _ := NewLocalFileFilterPersister(dir, RetentionPolicy{Keep: 3, MaxAge: time.Hour})
+
+	// link of filter test.7 looks like an expired snapshot of test
+	other, _ := NewClassicBloomFilter(FilterOptions{Name: "test.7", N: 100, ErrorRate: 0.1})
+	persistFilter(p, other)
+
+	f, _ := NewClassicBloomFilter(FilterOptions{Name: "test", N: 100, ErrorRate: 0.1})
+	f.Add([]byte("a"))
+	if err := persistFilter(p, f); err != nil {
+		t.Errorf("persist filter error: %v", err)
+		return
+	}
+
+	if names, _ := p.ListFilterNames(); len(names) != 2 {
+		t.Errorf("link of test.7 should be kept, got %v", names)
+	}
+
+	snapshots, err := p.ListSnapshots("test")
+	if err != nil {
+		t.Errorf("list snapshots error: %v", err)
+		return
+	}
+
+	if len(snapshots) != 3 || !snapshots[0].Current || snapshots[1].Timestamp != now-10 || snapshots[2].Timestamp != now-20 {
+		t.Errorf("retention error: %+v", snapshots)
+		return
+	}
+
+	reader, closer, err := p.NewSnapshotReader("test", snapshots[0].Timestamp)
+	if err != nil {
+		t.Errorf("open snapshot error: %v", err)
+		return
+	}
+	defer closer.Close()
+
+	if loaded, err := loadFilter(reader); err != nil || !loaded.Test([]byte("a")) {
+		t.Errorf("load snapshot error: %v", err)
+	}
+}
+
+// Ensures that persisting records dump duration, size and failures.
+func TestPersistFilterMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bfserver")
+	if err != nil {
+		t.Errorf("create temp dir error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	p, _ := NewLocalFileFilterPersister(dir, RetentionPolicy{})
+	f, _ := NewClassicBloomFilter(FilterOptions{Name: "dump_metrics", N: 100, ErrorRate: 0.1})
+	if err := persistFilter(p, f); err != nil {
+		t.Errorf("persist filter error: %v", err)
+		return
+	}
+
+	stat, _ := os.Stat(filepath.Join(dir, "dump_metrics"))
+	if size := dumpSize.Value("dump_metrics"); size != float64(stat.Size()) {
+		t.Errorf("dump size should be %d, got %v", stat.Size(), size)
+	}
+
+	os.RemoveAll(dir)
+	if err := persistFilter(p, f); err == nil {
+		t.Errorf("persist to removed dir should fail")
+	}
+
+	if n := dumpDuration.Count("dump_metrics"); n != 2 {
+		t.Errorf("expected 2 dumps, got %d", n)
+	}
+	if n := dumpFailures.Value("dump_metrics"); n != 1 {
+		t.Errorf("expected 1 failure, got %v", n)
+	}
+
+	forgetDumpMetrics("dump_metrics")
+	if dumpDuration.Count("dump_metrics") != 0 || dumpSize.Value("dump_metrics") != 0 {
+		t.Errorf("metrics of deleted filter should be dropped")
+	}
+}
+
+// Ensures that dumps of a filter in the same second don't clobber each other.
+func TestLocalFilePersisterConcurrentWriters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bfserver")
+	if err != nil {
+		t.Errorf("create temp dir error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	p, _ := NewLocalFileFilterPersister(dir, RetentionPolicy{})
+	f, _ := NewClassicBloomFilter(FilterOptions{Name: "test", N: 100, ErrorRate: 0.1})
+
+	w, _ := p.NewWriter("test")
+	done := make(chan error)
+	go func() {
+		done <- persistFilter(p, f)
+	}()
+
+	select {
+	case <-done:
+		t.Errorf("dump should wait for the running one")
+		return
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	w.Write([]byte("aborted"))
+	w.Abort()
+	if err := <-done; err != nil {
+		t.Errorf("dump after aborted one error: %v", err)
+	}
+
+	if err := persistFilter(p, f); err != nil {
+		t.Errorf("dump again error: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package bloom
+
+/*
+ *  @Describe: bounded worker pool running batch operations by shards
+ */
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/alecthomas/log4go"
+)
+
+const (
+	SEQUENTIAL_BATCH_SIZE = 64 // batches not larger than it run in caller
+)
+
+var (
+	// BatchWorkers is the size of worker pool, must be set before the first batch
+	BatchWorkers = runtime.NumCPU()
+
+	poolOnce  sync.Once
+	poolTasks chan func()
+)
+
+func startPool() {
+	workers := BatchWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	poolTasks = make(chan func(), workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for task := range poolTasks {
+				task()
+			}
+		}()
+	}
+
+	log4go.Info("started batch worker pool of %d workers", workers)
+}
+
+// runSharded calls fn with shards [start, end) of n items. Small batches run
+// sequentially in the caller, others are spread on the worker pool while the
+// caller works on the first shard
+func runSharded(n int, fn func(start, end int)) {
+	if n <= SEQUENTIAL_BATCH_SIZE || BatchWorkers <= 1 {
+		fn(0, n)
+		return
+	}
+
+	poolOnce.Do(startPool)
+
+	shards := (n + SEQUENTIAL_BATCH_SIZE - 1) / SEQUENTIAL_BATCH_SIZE
+	if shards > cap(poolTasks)+1 {
+		shards = cap(poolTasks) + 1
+	}
+	size := (n + shards - 1) / shards
+
+	var wg sync.WaitGroup
+	for start := size; start < n; start += size {
+		end := start + size
+		if end > n {
+			end = n
+		}
+
+		wg.Add(1)
+		s, e := start, end
+		poolTasks <- func() {
+			defer wg.Done()
+			fn(s, e)
+		}
+	}
+
+	fn(0, size)
+	wg.Wait()
+}
@@ -5,13 +5,22 @@ package bloom
  *  @Author  : Zhao Yulong (elysium.zyl@gmail.com)
  *  @Link    : ${link}
  *  @Describe: bloomfilter with routing
+ *
+ *  Keys are added to all r generations and tested against the current one.
+ *  Every rotate interval the current generation is reset and the next one
+ *  becomes current, so Test covers keys added in the last r-1 intervals plus
+ *  the time since last rotation.
+ *
+ *  In newest only mode keys are added to the newest generation only, which
+ *  is the one reset at last rotation, and Test ORs all generations. It covers
+ *  the same window with O(k) instead of O(r*k) adds, and each generation only
+ *  holds keys of its own interval.
  */
 
 import (
-	"bytes"
-	"encoding/gob"
 	"fmt"
 	"io"
+	"math"
 	"sync"
 	"time"
 
@@ -31,24 +40,12 @@ type RotatedBloomFilter struct {
 	current uint
 
 	rotateInterval time.Duration
-	lastRotated    time.Time
+	lastRotated    time.Time // rotations are aligned to it by rotateInterval
+	created        time.Time // when it's created or reset, no keys before it
+	newestOnly     bool      // adds to the newest generation only
 	innerFilters   []Filter
 }
 
-type RotatedBloomFilterHeader struct {
-	R       uint
-	Current uint
-	Name    string
-
-	RotatedInterval time.Duration
-	LastRotated     time.Time
-}
-
-type RotatedBloomFilterChunk struct {
-	BodyLen int32
-	Data    []byte
-}
-
 func NewRotatedBloomFilter(options FilterOptions) (Filter, error) {
 	if options.R <= 0 {
 		return nil, fmt.Errorf("invalid r, at least one")
@@ -64,11 +61,14 @@ func NewRotatedBloomFilter(options FilterOptions) (Filter, error) {
 		}
 	}
 
+	now := time.Now().Round(0) // same as loaded from dump
 	return &RotatedBloomFilter{
 		name:           options.Name,
 		r:              options.R,
 		rotateInterval: options.RotateInterval,
-		lastRotated:    time.Unix(0, 0),
+		lastRotated:    now,
+		created:        now,
+		newestOnly:     options.NewestOnly,
 
 		current:      0,
 		innerFilters: innerFilters,
@@ -84,14 +84,77 @@ func (b *RotatedBloomFilter) Capacity() uint {
 }
 
 func (b *RotatedBloomFilter) Count() uint {
-	return b.innerFilters[b.current].Count()
+	if !b.newestOnly {
+		return b.innerFilters[b.current].Count()
+	}
+
+	b.RLock()
+	defer b.RUnlock()
+
+	total := uint(0)
+	for _, filter := range b.innerFilters {
+		total += filter.Count()
+	}
+	return total
+}
+
+// NewestOnly returns whether keys are added to the newest generation only
+func (b *RotatedBloomFilter) NewestOnly() bool {
+	return b.newestOnly
+}
+
+// generations returns all generations, keys are tested in all of them in
+// newest only mode
+func (b *RotatedBloomFilter) generations() []Filter {
+	b.RLock()
+	defer b.RUnlock()
+
+	return append([]Filter{}, b.innerFilters...)
 }
+
+// EstimatedFillRatio is the mean of generations in newest only mode
 func (b *RotatedBloomFilter) EstimatedFillRatio() float64 {
-	return b.innerFilters[b.current].EstimatedFillRatio()
+	if !b.newestOnly {
+		return b.innerFilters[b.current].EstimatedFillRatio()
+	}
+
+	total := 0.0
+	for _, filter := range b.generations() {
+		total += filter.EstimatedFillRatio()
+	}
+	return total / float64(b.r)
 }
 
+// FillRatio is the mean of generations in newest only mode
 func (b *RotatedBloomFilter) FillRatio() float64 {
-	return b.innerFilters[b.current].FillRatio()
+	if !b.newestOnly {
+		return b.innerFilters[b.current].FillRatio()
+	}
+
+	total := 0.0
+	for _, filter := range b.generations() {
+		total += filter.FillRatio()
+	}
+	return total / float64(b.r)
+}
+
+// ErrorRate is of testing all generations in newest only mode
+func (b *RotatedBloomFilter) ErrorRate() float64 {
+	rate := b.innerFilters[b.current].ErrorRate()
+	if !b.newestOnly {
+		return rate
+	}
+
+	return 1 - math.Pow(1-rate, float64(b.r))
+}
+
+func (b *RotatedBloomFilter) Storage() uint64 {
+	total := uint64(0)
+	for _, filter := range b.innerFilters {
+		total += filter.Storage()
+	}
+
+	return total
 }
 
 func (b *RotatedBloomFilter) K() uint {
@@ -99,74 +162,261 @@ func (b *RotatedBloomFilter) K() uint {
 }
 
 func (b *RotatedBloomFilter) Reset() {
+	b.Lock()
+	defer b.Unlock()
+
 	for _, filter := range b.innerFilters {
 		filter.Reset()
 	}
+	b.created = time.Now().Round(0)
 }
 
 func (b *RotatedBloomFilter) Add(key []byte) Filter {
 	b.Lock()
 	defer b.Unlock()
 
-	ch := make(chan bool, b.r)
-
-	for i := 0; i < int(b.r); i++ {
-		go func(filter Filter) {
-			filter.Add(key)
-
-			ch <- true
-		}(b.innerFilters[i])
+	if b.newestOnly {
+		b.innerFilters[b.generation(1)].Add(key)
+		return b
 	}
 
-	for i := 0; i < int(b.r); i++ {
-		<-ch
+	for _, filter := range b.innerFilters {
+		filter.Add(key)
 	}
 
 	return b
 }
 
+func (b *RotatedBloomFilter) TestAndAdd(key []byte) bool {
+	return b.TestAndAddGenerations(key, 0)
+}
+
 func (b *RotatedBloomFilter) Test(key []byte) bool {
+	return b.TestGenerations(key, 0)
+}
+
+// generation returns index of the generation holding keys of the newest n
+// generations, as each one has all keys added since it was reset. n is taken
+// as r if it's zero or more than r.
+// this function is not thread safe
+func (b *RotatedBloomFilter) generation(n uint) uint {
+	if n == 0 || n > b.r {
+		n = b.r
+	}
+
+	return (b.current + b.r - n) % b.r
+}
+
+// TestGenerations tests key in the newest n generations, i.e. whether it's
+// added since n-1 intervals before last rotation, Test tests all r generations
+func (b *RotatedBloomFilter) TestGenerations(key []byte, n uint) bool {
 	b.RLock()
 	defer b.RUnlock()
-	return b.innerFilters[b.current].Test(key)
+
+	if !b.newestOnly {
+		return b.innerFilters[b.generation(n)].Test(key)
+	}
+
+	return b.testOlder(key, n) || b.innerFilters[b.generation(1)].Test(key)
 }
 
-func (b *RotatedBloomFilter) PeriodMaintaince(persister FilterPersister, force bool) error {
-	need_rotated := time.Now().Sub(b.lastRotated) >= b.rotateInterval
-	log4go.Info("period maintaince of %v, last rotated: %v, period:%v, need roated %v",
-		b.Name(), b.lastRotated, b.rotateInterval, need_rotated)
+// testOlder tests key in the newest n generations but the newest one of newest
+// only mode
+// this function is not thread safe
+func (b *RotatedBloomFilter) testOlder(key []byte, n uint) bool {
+	if n == 0 || n > b.r {
+		n = b.r
+	}
+
+	for i := uint(2); i <= n; i++ {
+		if b.innerFilters[b.generation(i)].Test(key) {
+			return true
+		}
+	}
 
-	if need_rotated || force {
-		writer, err := persister.NewWriter(b.name)
-		defer writer.Close()
+	return false
+}
 
-		log4go.Info("period rotated bloom filter: %s", b.name)
-		if err != nil {
-			log4go.Warn("create writer error:%v", err)
-			return err
+// TestAndAddGenerations adds key to all generations, or the newest one in
+// newest only mode, returns whether it existed in the newest n generations
+func (b *RotatedBloomFilter) TestAndAddGenerations(key []byte, n uint) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.newestOnly {
+		older := b.testOlder(key, n)
+		return b.innerFilters[b.generation(1)].TestAndAdd(key) || older
+	}
+
+	exists := false
+	g := b.generation(n)
+	for i := uint(0); i < b.r; i++ {
+		if b.innerFilters[i].TestAndAdd(key) && i == g {
+			exists = true
 		}
-		if err = dumpFilter(writer, b); err != nil {
-			log4go.Warn("dumpfilter error:%v", err)
+	}
+
+	return exists
+}
+
+// GenerationsWithin returns how many newest generations cover keys added
+// within d, it's rounded up so some older keys may be included, and r at
+// most though the window may be shorter than d
+func (b *RotatedBloomFilter) GenerationsWithin(d time.Duration) uint {
+	return b.generationsWithin(d, time.Now())
+}
+
+func (b *RotatedBloomFilter) generationsWithin(d time.Duration, now time.Time) uint {
+	b.RLock()
+	defer b.RUnlock()
+
+	// the newest generation covers keys since last rotation, each older one
+	// covers one more interval
+	d -= now.Sub(b.lastRotated)
+	if d <= 0 || b.rotateInterval <= 0 {
+		return 1
+	}
+
+	n := 1 + uint((d+b.rotateInterval-1)/b.rotateInterval)
+	if n > b.r {
+		n = b.r
+	}
+	return n
+}
+
+// PeriodMaintaince only dumps the filter, rotation is done by the rotation
+// scheduler of manager, see FilterManager.rotateWork
+func (b *RotatedBloomFilter) PeriodMaintaince(persister FilterPersister, force bool) error {
+	if force {
+		log4go.Info("period dump rotated bloom filter: %s", b.name)
+		return persistFilter(persister, b)
+	}
+
+	return nil
+}
+
+// NextRotation returns when the filter should rotate, zero if it never rotates
+func (b *RotatedBloomFilter) NextRotation() time.Time {
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.rotateInterval <= 0 {
+		return time.Time{}
+	}
+	return b.lastRotated.Add(b.rotateInterval)
+}
+
+// WindowStart returns since when added keys are tested as members, the window
+// ends now and the start moves on by rotate interval at each rotation
+func (b *RotatedBloomFilter) WindowStart() time.Time {
+	b.RLock()
+	defer b.RUnlock()
+
+	start := b.lastRotated.Add(-time.Duration(b.r-1) * b.rotateInterval)
+	if start.Before(b.created) {
+		return b.created
+	}
+	return start
+}
+
+// rotate drops generations expired at now, several ones if it's late, and
+// returns how many intervals passed. Rotations keep aligned to lastRotated so
+// the window doesn't drift by lateness.
+func (b *RotatedBloomFilter) rotate(now time.Time) uint {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.rotateInterval <= 0 || now.Before(b.lastRotated.Add(b.rotateInterval)) {
+		return 0
+	}
+
+	n := uint(now.Sub(b.lastRotated) / b.rotateInterval)
+	for i := uint(0); i < n && i < b.r; i++ {
+		b.dropOneRep()
+	}
+	b.lastRotated = b.lastRotated.Add(time.Duration(n) * b.rotateInterval)
+
+	log4go.Info("Filter %s rotated %d times to %d, next rotated time to %v", b.name, n, b.current, b.lastRotated.Add(b.rotateInterval))
+	return n
+}
+
+func (b *RotatedBloomFilter) Union(other Filter) error {
+	return b.merge(other, MERGE_UNION)
+}
+
+func (b *RotatedBloomFilter) Intersect(other Filter) error {
+	return b.merge(other, MERGE_INTERSECT)
+}
+
+// CheckMerge checks r and mode, and generations which share the params
+func (b *RotatedBloomFilter) CheckMerge(other Filter) error {
+	o, ok := other.(*RotatedBloomFilter)
+	if !ok {
+		return fmt.Errorf("can't merge %s filter into rotated filter", filterType(other))
+	}
+	if o == b {
+		return nil
+	}
+
+	// never hold locks of both, merges of the two ways may run at once
+	b.RLock()
+	r, newestOnly, generation := b.r, b.newestOnly, b.innerFilters[0]
+	b.RUnlock()
+
+	o.RLock()
+	oR, oNewestOnly, oGeneration := o.r, o.newestOnly, o.innerFilters[0]
+	o.RUnlock()
+
+	if oR != r || oNewestOnly != newestOnly {
+		return fmt.Errorf("can't merge filter of r:%d newest_only:%v into r:%d newest_only:%v", oR, oNewestOnly, r, newestOnly)
+	}
+
+	return checkMerge(generation, oGeneration, MERGE_UNION)
+}
+
+// merge merges generations of the same age one by one
+func (b *RotatedBloomFilter) merge(other Filter, op string) error {
+	if err := b.CheckMerge(other); err != nil {
+		return err
+	}
+
+	o := other.(*RotatedBloomFilter)
+	if o == b {
+		return nil
+	}
+
+	o.RLock()
+	current := o.current
+	generations := append([]Filter{}, o.innerFilters...)
+	o.RUnlock()
+
+	b.Lock()
+	defer b.Unlock()
+
+	for i := uint(0); i < b.r; i++ {
+		target := b.innerFilters[(b.current+i)%b.r]
+		if err := MergeFilter(target, generations[(current+i)%b.r], op); err != nil {
 			return err
-		} else {
-			if need_rotated {
-				last := b.lastRotated
-				b.Lock()
-				if b.lastRotated == last {
-					b.dropOneRep()
-					b.lastRotated = time.Now()
-
-					log4go.Info("Filter %s rotated to %d, next rotated time to %v", b.name, b.current, b.lastRotated.Add(b.rotateInterval))
-				}
-				b.Unlock()
-
-			}
 		}
 	}
 
 	return nil
 }
 
+// scopedFilter tests keys in the newest n generations of a rotated filter
+type scopedFilter struct {
+	*RotatedBloomFilter
+	n uint
+}
+
+func (f *scopedFilter) Test(key []byte) bool {
+	return f.TestGenerations(key, f.n)
+}
+
+func (f *scopedFilter) TestAndAdd(key []byte) bool {
+	return f.TestAndAddGenerations(key, f.n)
+}
+
 //this function is not thread safe
 func (b *RotatedBloomFilter) dropOneRep() {
 	b.innerFilters[b.current].Reset()
@@ -176,45 +426,39 @@ func (b *RotatedBloomFilter) dropOneRep() {
 func (b *RotatedBloomFilter) Destroy() {
 }
 
-func (b *RotatedBloomFilter) Load(r io.Reader) error {
-	b.RLock()
-	defer b.RUnlock()
-	dec := gob.NewDecoder(r)
+func (b *RotatedBloomFilter) Load(stream io.Reader) error {
+	b.Lock()
+	defer b.Unlock()
 
-	header := RotatedBloomFilterHeader{}
-	if err := dec.Decode(&header); err != nil {
-		log4go.Warn("load header error: %v", err)
+	r := newBinReader(stream)
+	t, meta := r.Section()
+	if r.err != nil || t != SECTION_ROTATED {
+		log4go.Warn("load header error: %v", r.err)
 		return ILLEGAL_LOAD_FORMAT
 	}
 
-	b.r = header.R
-	if b.r == 0 {
-		log4go.Warn("suspicous filter, r is zero")
+	b.name = meta.String()
+	b.r = uint(meta.U32())
+	b.current = uint(meta.U32())
+	b.rotateInterval = time.Duration(meta.I64())
+	b.lastRotated = time.Unix(0, meta.I64())
+	b.created = time.Unix(0, meta.I64())
+	b.newestOnly = meta.U8() != 0
+
+	if b.r == 0 || b.current >= b.r {
+		log4go.Warn("suspicous filter, r:%d current:%d", b.r, b.current)
 		return ILLEGAL_LOAD_FORMAT
 	}
 
-	b.current = header.Current
-	b.name = header.Name
-	b.lastRotated = header.LastRotated
-	b.rotateInterval = header.RotatedInterval
-
-	b.innerFilters = make([]Filter, b.r)
+	// r isn't checked by crc yet, grow by loaded sections instead of trusting it
+	b.innerFilters = make([]Filter, 0)
 
 	for i := uint(0); i < b.r; i++ {
-		chunk := RotatedBloomFilterChunk{}
-		if err := dec.Decode(&chunk); err != nil {
-			log4go.Warn("get chunk of %d error: %v", i, err)
-			return ILLEGAL_LOAD_FORMAT
-		}
-
-		if len(chunk.Data) != int(chunk.BodyLen) {
-			log4go.Warn("chunk %d len %d not equal to data len %d", chunk.BodyLen, len(chunk.Data))
-		}
-		if filter, err := loadFilter(bytes.NewBuffer(chunk.Data)); err != nil {
-			log4go.Warn("load filter error: %v", err)
+		if filter, err := loadSection(r); err != nil {
+			log4go.Warn("load filter %d error: %v", i, err)
 			return ILLEGAL_LOAD_FORMAT
 		} else {
-			b.innerFilters[i] = filter
+			b.innerFilters = append(b.innerFilters, filter)
 		}
 	}
 
@@ -223,37 +467,51 @@ func (b *RotatedBloomFilter) Load(r io.Reader) error {
 	return nil
 }
 
-func (b *RotatedBloomFilter) Dump(w io.Writer) error {
-	enc := gob.NewEncoder(w)
-
-	header := RotatedBloomFilterHeader{
-		R:               b.r,
-		Current:         b.current,
-		Name:            b.name,
-		LastRotated:     b.lastRotated,
-		RotatedInterval: b.rotateInterval,
-	}
-
-	if err := enc.Encode(&header); err != nil {
-		log4go.Warn("write header error: %v", err)
-		return err
+func (b *RotatedBloomFilter) Dump(stream io.Writer) error {
+	// state is copied as rotation changes it, generations are written
+	// without lock so adds aren't blocked by the dump
+	b.RLock()
+	name, r, current := b.name, b.r, b.current
+	rotateInterval, lastRotated, created := b.rotateInterval, b.lastRotated, b.created
+	newestOnly := b.newestOnly
+	generations := append([]Filter{}, b.innerFilters...)
+	b.RUnlock()
+
+	w := newBinWriter(stream)
+
+	w.Section(SECTION_ROTATED, func(meta *binWriter) {
+		meta.String(name)
+		meta.U32(uint32(r))
+		meta.U32(uint32(current))
+		meta.I64(int64(rotateInterval))
+		meta.I64(lastRotated.UnixNano())
+		meta.I64(created.UnixNano())
+		if newestOnly {
+			meta.U8(1)
+		} else {
+			meta.U8(0)
+		}
+	})
+	if w.err != nil {
+		log4go.Warn("write header error: %v", w.err)
+		return w.err
 	}
 
-	for i := 0; i < int(b.r); i++ {
-		buffer := new(bytes.Buffer)
-
-		if err := dumpFilter(buffer, b.innerFilters[i]); err != nil {
+	for i, filter := range generations {
+		if err := dumpSection(w, filter); err != nil {
 			log4go.Warn("write inner filter %d error: %v", i, err)
 			return err
 		}
+	}
 
-		if err := enc.Encode(&RotatedBloomFilterChunk{
-			BodyLen: int32(buffer.Len()),
-			Data:    buffer.Bytes(),
-		}); err != nil {
-			log4go.Warn("write chunked error: %v", err)
-			return err
-		}
+	// a rotation while writing resets a generation which doesn't match
+	// current written, the dump is retried later
+	b.RLock()
+	rotated := b.current != current || !b.lastRotated.Equal(lastRotated)
+	b.RUnlock()
+	if rotated {
+		log4go.Warn("filter %s rotated while dumping", name)
+		return ROTATED_ERROR
 	}
 
 	return nil
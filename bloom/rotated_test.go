@@ -2,6 +2,8 @@ package bloom
 
 import (
 	"bufio"
+	"bytes"
+	"math"
 	"os"
 	"strconv"
 	"testing"
@@ -9,7 +11,8 @@ import (
 )
 
 func rotatedBloomfilterEquals(a, b *RotatedBloomFilter) bool {
-	if a.name != b.name || a.r != b.r || a.current != b.current || a.rotateInterval != b.rotateInterval || a.lastRotated != b.lastRotated {
+	if a.name != b.name || a.r != b.r || a.current != b.current || a.rotateInterval != b.rotateInterval || a.lastRotated != b.lastRotated ||
+		a.newestOnly != b.newestOnly {
 		return false
 	}
 
@@ -51,6 +54,30 @@ func TestRotatedBloomTest(t *testing.T) {
 
 }
 
+func TestRotatedBloomTestAndAdd(t *testing.T) {
+	filter, err := NewRotatedBloomFilter(FilterOptions{Name: "test", ErrorRate: 0.05, N: 100000, R: 7})
+	if err != nil {
+		t.Errorf("error: %v", err)
+		return
+	}
+
+	if filter.TestAndAdd([]byte("a")) {
+		t.Errorf("false positive error")
+	}
+
+	f := filter.(*RotatedBloomFilter)
+	for i := 0; i < int(f.r); i++ {
+		if !f.innerFilters[i].Test([]byte("a")) {
+			t.Errorf("key not added to filter %d", i)
+		}
+	}
+
+	f.dropOneRep()
+	if !filter.TestAndAdd([]byte("a")) {
+		t.Errorf("true negative error")
+	}
+}
+
 func TestRotatedFilterDumpLoad(t *testing.T) {
 	c, err := NewRotatedBloomFilter(FilterOptions{
 		Name:           "test",
@@ -92,6 +119,139 @@ func TestRotatedFilterDumpLoad(t *testing.T) {
 	}
 }
 
+// rotatingWriter rotates f at the first write
+type rotatingWriter struct {
+	bytes.Buffer
+	f       *RotatedBloomFilter
+	rotated bool
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	if !w.rotated {
+		w.rotated = true
+		w.f.rotate(w.f.lastRotated.Add(w.f.rotateInterval))
+	}
+
+	return w.Buffer.Write(p)
+}
+
+// Ensures that a dump fails if the filter rotated while writing, and adds
+// aren't blocked by it.
+func TestRotatedDumpWhileRotating(t *testing.T) {
+	c, _ := NewRotatedBloomFilter(FilterOptions{Name: "test", ErrorRate: 0.05, N: 1000, R: 3, RotateInterval: time.Hour})
+	f := c.(*RotatedBloomFilter)
+
+	if err := f.Dump(&rotatingWriter{f: f}); err != ROTATED_ERROR {
+		t.Errorf("dump rotated while writing should fail, got %v", err)
+	}
+	if err := f.Dump(new(bytes.Buffer)); err != nil {
+		t.Errorf("dump error: %v", err)
+	}
+}
+
+func TestRotatedFilterInfo(t *testing.T) {
+	filter, err := NewRotatedBloomFilter(FilterOptions{
+		Name:           "test",
+		ErrorRate:      0.1,
+		N:              100,
+		R:              7,
+		RotateInterval: time.Hour,
+	})
+	if err != nil {
+		t.Errorf("create rotated filter error: %v", err)
+		return
+	}
+
+	filter.Add([]byte("a"))
+
+	info := GetFilterInfo(filter)
+	if info.Type != FILTER_ROTATED || info.Name != "test" {
+		t.Errorf("info type error: %+v", info)
+	}
+	if info.Capacity != 480 || info.K != 4 || info.Count != 1 || info.ErrorRate != 0.1 {
+		t.Errorf("info stats error: %+v", info)
+	}
+	if info.Storage != 64*7 {
+		t.Errorf("info storage error, expected %d, got %d", 64*7, info.Storage)
+	}
+	if info.R != 7 || info.Current != 0 || info.RotateInterval != time.Hour {
+		t.Errorf("info rotation error: %+v", info)
+	}
+	if !info.WindowStart.Equal(info.LastRotated) || !info.NextRotation.Equal(info.LastRotated.Add(time.Hour)) {
+		t.Errorf("info window error: %+v", info)
+	}
+}
+
+// Ensures that the window starts r-1 intervals before last rotation, but not
+// before the filter was created.
+func TestRotatedWindowStart(t *testing.T) {
+	filter, _ := NewRotatedBloomFilter(FilterOptions{Name: "test", ErrorRate: 0.1, N: 100, R: 3, RotateInterval: time.Minute})
+	f := filter.(*RotatedBloomFilter)
+	created := f.created
+
+	f.rotate(created.Add(time.Minute))
+	if start := f.WindowStart(); !start.Equal(created) {
+		t.Errorf("window should start at creation %v, got %v", created, start)
+	}
+
+	f.rotate(created.Add(5 * time.Minute))
+	if start := f.WindowStart(); !start.Equal(created.Add(3 * time.Minute)) {
+		t.Errorf("window should start 2 intervals before last rotation, got %v", start)
+	}
+}
+
+// Ensures that the rotation scheduler rotates due filters and waits for the
+// next due one.
+func TestManagerRotateDue(t *testing.T) {
+	m, _ := NewFilterManager(nil, 0)
+	m.AddNewBloomFilter(FILTER_CLASSIC, FilterOptions{Name: "classic", ErrorRate: 0.1, N: 100})
+	filter, _ := m.AddNewBloomFilter(FILTER_ROTATED, FilterOptions{Name: "test", ErrorRate: 0.1, N: 100, R: 3, RotateInterval: 10 * time.Second})
+	f := filter.(*RotatedBloomFilter)
+	created := f.created
+
+	if wait := m.rotateDue(created.Add(time.Second)); wait != 9*time.Second || f.current != 0 {
+		t.Errorf("should wait 9s without rotation, wait %v current %d", wait, f.current)
+	}
+
+	if wait := m.rotateDue(created.Add(15 * time.Second)); wait != 5*time.Second || f.current != 1 {
+		t.Errorf("should rotate and wait 5s, wait %v current %d", wait, f.current)
+	}
+
+	m.Filters = map[string]Filter{}
+	if wait := m.rotateDue(created); wait != ROTATE_CHECK_PERIOD {
+		t.Errorf("should wait %v without rotated filters, wait %v", ROTATE_CHECK_PERIOD, wait)
+	}
+}
+
+// Ensures that rotated filters merge generations of the same age.
+func TestRotatedBloomUnion(t *testing.T) {
+	options := FilterOptions{Name: "test", ErrorRate: 0.01, N: 1000, R: 3}
+	a, _ := NewRotatedBloomFilter(options)
+	b, _ := NewRotatedBloomFilter(options)
+
+	b.Add([]byte("old"))
+	b.(*RotatedBloomFilter).dropOneRep()
+	b.Add([]byte("new"))
+
+	if err := MergeFilter(a, b, MERGE_UNION); err != nil {
+		t.Errorf("union error: %v", err)
+		return
+	}
+
+	f := a.(*RotatedBloomFilter)
+	if !a.Test([]byte("old")) || !a.Test([]byte("new")) {
+		t.Errorf("merged keys should be in current generation")
+	}
+	if f.innerFilters[2].Test([]byte("old")) || !f.innerFilters[2].Test([]byte("new")) {
+		t.Errorf("newest generation should only have new keys")
+	}
+
+	c, _ := NewRotatedBloomFilter(FilterOptions{Name: "test", ErrorRate: 0.01, N: 1000, R: 4})
+	if err := MergeFilter(a, c, MERGE_UNION); err == nil {
+		t.Errorf("merge filters of different r should fail")
+	}
+}
+
 func BenchmarkRotatedBloomAdd(b *testing.B) {
 	b.StopTimer()
 	filter, err := NewRotatedBloomFilter(FilterOptions{Name: "test", ErrorRate: 0.05, N: 100000, R: 7})
@@ -110,6 +270,24 @@ func BenchmarkRotatedBloomAdd(b *testing.B) {
 	}
 }
 
+func BenchmarkRotatedBloomAddNewestOnly(b *testing.B) {
+	b.StopTimer()
+	filter, err := NewRotatedBloomFilter(FilterOptions{Name: "test", ErrorRate: 0.05, N: 100000, R: 7, NewestOnly: true})
+	if err != nil {
+		b.Errorf("create rotated filter error: %v", err)
+		return
+	}
+	data := make([][]byte, b.N)
+	for i := 0; i < b.N; i++ {
+		data[i] = []byte(strconv.Itoa(i))
+	}
+
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		filter.Add(data[i])
+	}
+}
+
 func BenchmarkRotatedBloomTest(b *testing.B) {
 	b.StopTimer()
 	filter, err := NewRotatedBloomFilter(FilterOptions{Name: "test", ErrorRate: 0.05, N: 100000, R: 7})
@@ -145,3 +323,202 @@ func GetDictionarys() [][]byte {
 
 	return ret
 }
+
+// Ensures that keys are tested in the newest generations only by scope.
+func TestRotatedTestGenerations(t *testing.T) {
+	m, _ := NewFilterManager(nil, 0)
+	filter, _ := m.AddNewBloomFilter(FILTER_ROTATED, FilterOptions{Name: "test", ErrorRate: 0.01, N: 1000, R: 3, RotateInterval: time.Minute})
+	f := filter.(*RotatedBloomFilter)
+	// last rotated 30s ago
+	created := time.Now().Add(-150 * time.Second).Round(0)
+	f.created, f.lastRotated = created, created
+
+	f.Add([]byte("old"))
+	f.rotate(created.Add(time.Minute))
+	f.Add([]byte("mid"))
+	f.rotate(created.Add(2 * time.Minute))
+	f.Add([]byte("new"))
+
+	expected := map[uint][]bool{
+		0: {true, true, true},
+		1: {false, false, true},
+		2: {false, true, true},
+		3: {true, true, true},
+		9: {true, true, true},
+	}
+	for n, exists := range expected {
+		scoped, err := ScopeFilter(f, TestScope{Generations: n})
+		if err != nil {
+			t.Errorf("scope filter error: %v", err)
+			continue
+		}
+
+		ret, _ := BatchTest(scoped, []string{"old", "mid", "new"})
+		for i := range ret {
+			if ret[i] != exists[i] {
+				t.Errorf("generations %d: expected %v, got %v", n, exists, ret)
+				break
+			}
+		}
+	}
+
+	ret, exists, err := m.TestAndAddKeys("test", []string{"old", "other"}, TestScope{Generations: 1})
+	if err != nil || exists != 0 || ret[0] || ret[1] {
+		t.Errorf("old should not exist in newest generation, got %v %v", ret, err)
+	}
+	if !f.TestGenerations([]byte("old"), 1) {
+		t.Errorf("old should be added to newest generation")
+	}
+
+	results := m.MultiTest([]MultiEntry{
+		{Name: "test", Keys: []string{"mid"}, Scope: TestScope{Within: time.Second}},
+		{Name: "test", Keys: []string{"mid"}, Scope: TestScope{Within: time.Hour}},
+	})
+	if results[0].Err != nil || results[0].Exists[0] || results[1].Err != nil || !results[1].Exists[0] {
+		t.Errorf("mid should only be seen within an hour, got %+v", results)
+	}
+
+	c, _ := NewClassicBloomFilter(FilterOptions{Name: "classic", ErrorRate: 0.01, N: 1000})
+	if _, err := ScopeFilter(c, TestScope{Generations: 1}); err == nil {
+		t.Errorf("classic filter should not be scoped")
+	}
+	if _, err := ScopeFilter(f, TestScope{Generations: 1, Within: time.Hour}); err == nil {
+		t.Errorf("generations and within should not be both set")
+	}
+	if scoped, _ := ScopeFilter(c, TestScope{}); scoped != c {
+		t.Errorf("zero scope should test the whole filter")
+	}
+}
+
+// Ensures that durations are rounded up to generations and capped by r.
+func TestRotatedGenerationsWithin(t *testing.T) {
+	filter, _ := NewRotatedBloomFilter(FilterOptions{Name: "test", ErrorRate: 0.1, N: 100, R: 3, RotateInterval: time.Minute})
+	f := filter.(*RotatedBloomFilter)
+	now := f.lastRotated.Add(30 * time.Second)
+
+	cases := []struct {
+		within      time.Duration
+		generations uint
+	}{
+		{10 * time.Second, 1},
+		{30 * time.Second, 1},
+		{time.Minute, 2},
+		{90 * time.Second, 2},
+		{91 * time.Second, 3},
+		{time.Hour, 3},
+	}
+	for _, c := range cases {
+		if n := f.generationsWithin(c.within, now); n != c.generations {
+			t.Errorf("within %v: expected %d generations, got %d", c.within, c.generations, n)
+		}
+	}
+}
+
+// Ensures that newest only mode adds keys to the newest generation and tests
+// all generations in scope.
+func TestRotatedNewestOnly(t *testing.T) {
+	filter, _ := NewRotatedBloomFilter(FilterOptions{Name: "test", ErrorRate: 0.01, N: 1000, R: 3, RotateInterval: time.Minute, NewestOnly: true})
+	f := filter.(*RotatedBloomFilter)
+	created := f.created
+
+	f.Add([]byte("old"))
+	f.rotate(created.Add(time.Minute))
+	f.Add([]byte("mid"))
+	f.rotate(created.Add(2 * time.Minute))
+	f.Add([]byte("new"))
+
+	for i, inner := range f.innerFilters {
+		if inner.Count() != 1 {
+			t.Errorf("generation %d should have one key, got %d", i, inner.Count())
+		}
+	}
+	if count := f.Count(); count != 3 {
+		t.Errorf("Expected 3, got %d", count)
+	}
+
+	expected := map[uint][]bool{
+		0: {true, true, true},
+		1: {false, false, true},
+		2: {false, true, true},
+		3: {true, true, true},
+	}
+	for n, exists := range expected {
+		for i, key := range []string{"old", "mid", "new"} {
+			if f.TestGenerations([]byte(key), n) != exists[i] {
+				t.Errorf("generations %d: expected %s exists %v", n, key, exists[i])
+			}
+		}
+	}
+
+	if f.TestAndAddGenerations([]byte("old"), 2) || !f.TestAndAdd([]byte("old")) {
+		t.Errorf("old should only exist in the oldest generation before added")
+	}
+	if !f.innerFilters[f.generation(1)].Test([]byte("old")) {
+		t.Errorf("old should be added to the newest generation")
+	}
+
+	f.rotate(created.Add(3 * time.Minute))
+	if !f.Test([]byte("mid")) || !f.Test([]byte("new")) {
+		t.Errorf("mid and new should be in window")
+	}
+
+	buf := &bytes.Buffer{}
+	if err := WriteDump(buf, f); err != nil {
+		t.Fatalf("dump error: %v", err)
+	}
+	loaded, _, err := LoadDump(buf)
+	if err != nil {
+		t.Fatalf("load error: %v", err)
+	}
+	if !rotatedBloomfilterEquals(f, loaded.(*RotatedBloomFilter)) {
+		t.Errorf("loaded filter should be newest only")
+	}
+
+	all, _ := NewRotatedBloomFilter(FilterOptions{Name: "test", ErrorRate: 0.01, N: 1000, R: 3})
+	if err := MergeFilter(f, all, MERGE_UNION); err == nil {
+		t.Errorf("merge filters of different modes should fail")
+	}
+}
+
+// Ensures that fill and false positive rates of newest only filter cover
+// all generations, not the oldest one only.
+func TestRotatedNewestOnlyRates(t *testing.T) {
+	filter, _ := NewRotatedBloomFilter(FilterOptions{Name: "test", ErrorRate: 0.01, N: 1000, R: 3, RotateInterval: time.Minute, NewestOnly: true})
+	f := filter.(*RotatedBloomFilter)
+	created := f.created
+
+	for g := 0; g < 3; g++ {
+		if g > 0 {
+			f.rotate(created.Add(time.Duration(g) * time.Minute))
+		}
+		for i := 0; i < 1000; i++ {
+			f.Add([]byte(strconv.Itoa(g*1000 + i)))
+		}
+	}
+
+	single := EstimatedFalsePositiveRate(f.innerFilters[0])
+	if rate := EstimatedFalsePositiveRate(f); math.Abs(rate-(1-math.Pow(1-single, 3))) > single/2 {
+		t.Errorf("false positive rate %f should be of 3 generations of %f", rate, single)
+	}
+
+	if rate := falsePositiveRate(f, 3000, 100000); rate < 0.015 || rate > 0.05 {
+		t.Errorf("measured false positive rate %f should be near 0.03", rate)
+	}
+
+	if ratio := f.FillRatio(); math.Abs(ratio-f.innerFilters[0].FillRatio()) > 0.05 {
+		t.Errorf("fill ratio %f should be near full generation %f", ratio, f.innerFilters[0].FillRatio())
+	}
+
+	if rate := f.ErrorRate(); math.Abs(rate-0.0297) > 0.001 {
+		t.Errorf("error rate should be of 3 generations, got %f", rate)
+	}
+
+	// keys of a new filter are in the newest generation, not the current one
+	filter, _ = NewRotatedBloomFilter(FilterOptions{Name: "test", ErrorRate: 0.01, N: 1000, R: 3, RotateInterval: time.Minute, NewestOnly: true})
+	for i := 0; i < 1000; i++ {
+		filter.Add([]byte(strconv.Itoa(i)))
+	}
+	if ratio := filter.EstimatedFillRatio(); math.Abs(ratio-0.5/3) > 0.01 {
+		t.Errorf("estimated fill ratio %f should be a third of a full generation", ratio)
+	}
+}
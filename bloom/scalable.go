@@ -0,0 +1,294 @@
+package bloom
+
+/*
+ *  @Describe: bloomfilter which chains classic filters when filled up
+ */
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/alecthomas/log4go"
+)
+
+const (
+	SCALABLE_GROWTH           = 2   // capacity multiplier of each new stage
+	SCALABLE_TIGHTENING_RATIO = 0.8 // error rate multiplier of each new stage
+)
+
+type ScalableBloomFilter struct {
+	sync.RWMutex
+
+	name      string
+	n         uint    // keys count of the first stage
+	errorRate float64 // overall error rate
+	hash      byte    // kind of hash function of stages
+
+	stages []Filter
+}
+
+func NewScalableBloomFilter(options FilterOptions) (Filter, error) {
+	if options.ErrorRate == 0 || options.N == 0 {
+		return nil, fmt.Errorf("illegal params")
+	}
+
+	hash, err := hashKindOf(options.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &ScalableBloomFilter{
+		name:      options.Name,
+		n:         options.N,
+		errorRate: options.ErrorRate,
+		hash:      hash,
+		stages:    make([]Filter, 0),
+	}
+
+	if err := b.addStage(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// stage i holds n*GROWTH^i keys with error rate p*(1-r)*r^i, so the
+// compounded error rate stays under p no matter how many stages are chained
+func (b *ScalableBloomFilter) stageOptions(i int) FilterOptions {
+	options := FilterOptions{
+		Name:      b.name,
+		N:         b.n,
+		ErrorRate: b.errorRate * (1 - SCALABLE_TIGHTENING_RATIO),
+		Hash:      hashName(b.hash),
+	}
+
+	for j := 0; j < i; j++ {
+		options.N *= SCALABLE_GROWTH
+		options.ErrorRate *= SCALABLE_TIGHTENING_RATIO
+	}
+
+	return options
+}
+
+// this function is not thread safe
+func (b *ScalableBloomFilter) addStage() error {
+	f, err := NewClassicBloomFilter(b.stageOptions(len(b.stages)))
+	if err != nil {
+		return err
+	}
+
+	b.stages = append(b.stages, f)
+	return nil
+}
+
+func (b *ScalableBloomFilter) last() Filter {
+	return b.stages[len(b.stages)-1]
+}
+
+func (b *ScalableBloomFilter) Name() string {
+	return b.name
+}
+
+func (b *ScalableBloomFilter) Capacity() uint {
+	b.RLock()
+	defer b.RUnlock()
+
+	total := uint(0)
+	for _, f := range b.stages {
+		total += f.Capacity()
+	}
+
+	return total
+}
+
+func (b *ScalableBloomFilter) K() uint {
+	b.RLock()
+	defer b.RUnlock()
+
+	return b.last().K()
+}
+
+func (b *ScalableBloomFilter) Count() uint {
+	b.RLock()
+	defer b.RUnlock()
+
+	total := uint(0)
+	for _, f := range b.stages {
+		total += f.Count()
+	}
+
+	return total
+}
+
+func (b *ScalableBloomFilter) ErrorRate() float64 {
+	return b.errorRate
+}
+
+func (b *ScalableBloomFilter) EstimatedFillRatio() float64 {
+	b.RLock()
+	defer b.RUnlock()
+
+	return b.last().EstimatedFillRatio()
+}
+
+func (b *ScalableBloomFilter) FillRatio() float64 {
+	b.RLock()
+	defer b.RUnlock()
+
+	return b.last().FillRatio()
+}
+
+func (b *ScalableBloomFilter) Storage() uint64 {
+	b.RLock()
+	defer b.RUnlock()
+
+	total := uint64(0)
+	for _, f := range b.stages {
+		total += f.Storage()
+	}
+
+	return total
+}
+
+func (b *ScalableBloomFilter) Stages() int {
+	b.RLock()
+	defer b.RUnlock()
+
+	return len(b.stages)
+}
+
+func (b *ScalableBloomFilter) Test(key []byte) bool {
+	b.RLock()
+	defer b.RUnlock()
+
+	for _, f := range b.stages {
+		if f.Test(key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *ScalableBloomFilter) Add(key []byte) Filter {
+	b.Lock()
+	defer b.Unlock()
+
+	b.add(key)
+	return b
+}
+
+func (b *ScalableBloomFilter) TestAndAdd(key []byte) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, f := range b.stages {
+		if f.Test(key) {
+			return true
+		}
+	}
+
+	b.add(key)
+	return false
+}
+
+// this function is not thread safe
+func (b *ScalableBloomFilter) add(key []byte) {
+	if b.last().EstimatedFillRatio() >= DEFAULT_FILL_RATIO {
+		if err := b.addStage(); err != nil {
+			log4go.Warn("add stage of %s error: %v", b.name, err)
+		} else {
+			log4go.Info("filter %s scaled to %d stages", b.name, len(b.stages))
+		}
+	}
+
+	b.last().Add(key)
+}
+
+func (b *ScalableBloomFilter) Reset() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.stages = b.stages[:1]
+	b.stages[0].Reset()
+}
+
+func (b *ScalableBloomFilter) PeriodMaintaince(persister FilterPersister, force bool) error {
+	if force {
+		log4go.Info("period dump scalable bloom filter: %s", b.name)
+		return persistFilter(persister, b)
+	}
+
+	return nil
+}
+
+func (b *ScalableBloomFilter) Load(stream io.Reader) error {
+	b.Lock()
+	defer b.Unlock()
+
+	r := newBinReader(stream)
+	t, meta := r.Section()
+	if r.err != nil || t != SECTION_SCALABLE {
+		log4go.Warn("load header error: %v", r.err)
+		return ILLEGAL_LOAD_FORMAT
+	}
+
+	b.name = meta.String()
+	b.n = uint(meta.U64())
+	b.errorRate = meta.F64()
+	stages := meta.U32()
+	b.hash = meta.U8()
+	if hashName(b.hash) == "" {
+		log4go.Warn("unknown hash kind %d", b.hash)
+		return ILLEGAL_LOAD_FORMAT
+	}
+
+	if stages == 0 {
+		log4go.Warn("suspicous filter, stages is zero")
+		return ILLEGAL_LOAD_FORMAT
+	}
+
+	// stages isn't checked by crc yet, grow by loaded sections instead of trusting it
+	b.stages = make([]Filter, 0)
+
+	for i := uint32(0); i < stages; i++ {
+		if filter, err := loadSection(r); err != nil {
+			log4go.Warn("load stage %d error: %v", i, err)
+			return ILLEGAL_LOAD_FORMAT
+		} else {
+			b.stages = append(b.stages, filter)
+		}
+	}
+
+	log4go.Info("load scalable filter, name:%s n:%d error_rate:%v stages:%d", b.name, b.n, b.errorRate, len(b.stages))
+	return nil
+}
+
+func (b *ScalableBloomFilter) Dump(stream io.Writer) error {
+	b.RLock()
+	defer b.RUnlock()
+
+	w := newBinWriter(stream)
+
+	w.Section(SECTION_SCALABLE, func(meta *binWriter) {
+		meta.String(b.name)
+		meta.U64(uint64(b.n))
+		meta.F64(b.errorRate)
+		meta.U32(uint32(len(b.stages)))
+		meta.U8(b.hash)
+	})
+	if w.err != nil {
+		log4go.Warn("write header error: %v", w.err)
+		return w.err
+	}
+
+	for i, filter := range b.stages {
+		if err := dumpSection(w, filter); err != nil {
+			log4go.Warn("write stage %d error: %v", i, err)
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package bloom
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+// Ensures that the filter adds new stages when filled up and keys in old
+// stages are still members.
+func TestScalableBloomGrow(t *testing.T) {
+	fs, _ := NewScalableBloomFilter(FilterOptions{Name: "test", N: 100, ErrorRate: 0.01})
+	f := fs.(*ScalableBloomFilter)
+
+	if stages := f.Stages(); stages != 1 {
+		t.Errorf("Expected 1 stage, got %d", stages)
+	}
+
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	if stages := f.Stages(); stages < 3 {
+		t.Errorf("Expected at least 3 stages, got %d", stages)
+	}
+
+	if count := f.Count(); count != 1000 {
+		t.Errorf("Expected 1000, got %d", count)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("%d should be a member", i)
+		}
+	}
+
+	for i, stage := range f.stages {
+		if i > 0 && stage.ErrorRate() >= f.stages[i-1].ErrorRate() {
+			t.Errorf("stage %d error rate should be tighter", i)
+		}
+	}
+}
+
+// Ensures that the false positive rate keeps bounded after the filter scaled.
+func TestScalableBloomErrorRate(t *testing.T) {
+	f, _ := NewScalableBloomFilter(FilterOptions{Name: "test", N: 100, ErrorRate: 0.01})
+	for i := 0; i < 10000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	fp := 0
+	for i := 10000; i < 20000; i++ {
+		if f.Test([]byte(strconv.Itoa(i))) {
+			fp++
+		}
+	}
+
+	if rate := float64(fp) / 10000; rate > 0.02 {
+		t.Errorf("false positive rate %f is too high", rate)
+	}
+}
+
+func TestScalableBloomDumpLoad(t *testing.T) {
+	c, _ := NewScalableBloomFilter(FilterOptions{Name: "test", N: 100, ErrorRate: 0.01})
+	for i := 0; i < 500; i++ {
+		c.Add([]byte(strconv.Itoa(i)))
+	}
+
+	buffer := new(bytes.Buffer)
+	if err := dumpFilter(buffer, c); err != nil {
+		t.Errorf("dump filter error: %v", err)
+		return
+	}
+
+	f, err := loadFilter(buffer)
+	if err != nil {
+		t.Errorf("load filter error: %v", err)
+		return
+	}
+
+	a, b := c.(*ScalableBloomFilter), f.(*ScalableBloomFilter)
+	if a.name != b.name || a.n != b.n || a.errorRate != b.errorRate || len(a.stages) != len(b.stages) {
+		t.Errorf("load filter error")
+		return
+	}
+
+	for i := range a.stages {
+		if !classicBloomFilterEqual(a.stages[i].(*ClassicBloomFilter), b.stages[i].(*ClassicBloomFilter)) {
+			t.Errorf("stage %d not equal", i)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package bloom
+
+/*
+ *  @Describe: bloomfilter whose keys expire after ttl. Each cell keeps the
+ *  stamp of the epoch it was last set in, an epoch is ttl/TTL_EPOCHS, a key
+ *  is a member while all its cells are at most TTL_EPOCHS epochs old, so it
+ *  lives between ttl and ttl*(1+1/TTL_EPOCHS). Expired cells are cleared by
+ *  decay steps in PeriodMaintaince, before stamps wrap around.
+ */
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/log4go"
+)
+
+const (
+	TTL_STAMP_BITS   = 8
+	TTL_STAMPS       = 1<<TTL_STAMP_BITS - 1       // stamps are 1..TTL_STAMPS, 0 is empty
+	TTL_EPOCHS       = 64                          // epochs of a ttl
+	TTL_SWEEP_EPOCHS = TTL_STAMPS - TTL_EPOCHS - 1 // longest gap of decay steps so ages don't wrap
+)
+
+type TTLBloomFilter struct {
+	sync.RWMutex
+
+	name      string
+	m         uint          // filter size
+	k         uint          // number of hash functions
+	errorRate float64       // configured false positive rate
+	hash      byte          // kind of hash function
+	ttl       time.Duration // keys expire after it
+	swept     uint64        // epoch of last decay step
+	latest    uint64        // epoch of latest add
+
+	buckets *Buckets // stamps of cells
+}
+
+func NewTTLBloomFilter(options FilterOptions) (Filter, error) {
+	if options.ErrorRate == 0 || options.N == 0 {
+		return nil, fmt.Errorf("illegal params")
+	}
+	if options.TTL < TTL_EPOCHS {
+		return nil, fmt.Errorf("illegal ttl %v", options.TTL)
+	}
+
+	hash, err := hashKindOf(options.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	m := OptimalM(options.N, options.ErrorRate)
+
+	b := &TTLBloomFilter{
+		name:      options.Name,
+		buckets:   NewBuckets(m, TTL_STAMP_BITS),
+		m:         m,
+		k:         OptimalK(options.ErrorRate),
+		errorRate: options.ErrorRate,
+		hash:      hash,
+		ttl:       options.TTL,
+	}
+	b.swept = b.epoch(time.Now())
+	b.latest = b.swept
+
+	return b, nil
+}
+
+func (b *TTLBloomFilter) Name() string {
+	return b.name
+}
+
+func (b *TTLBloomFilter) Capacity() uint {
+	return b.m
+}
+
+func (b *TTLBloomFilter) K() uint {
+	return b.k
+}
+
+func (b *TTLBloomFilter) TTL() time.Duration {
+	return b.ttl
+}
+
+// Count estimates keys not expired by cells in use
+func (b *TTLBloomFilter) Count() uint {
+	live := b.live()
+	if live >= b.m {
+		live = b.m - 1
+	}
+
+	return uint(-float64(b.m)/float64(b.k)*math.Log(1-float64(live)/float64(b.m)) + 0.5)
+}
+
+func (b *TTLBloomFilter) ErrorRate() float64 {
+	return b.errorRate
+}
+
+func (b *TTLBloomFilter) Storage() uint64 {
+	return b.buckets.Storage()
+}
+
+func (b *TTLBloomFilter) EstimatedFillRatio() float64 {
+	return 1 - math.Exp((-float64(b.Count())*float64(b.k))/float64(b.m))
+}
+
+func (b *TTLBloomFilter) FillRatio() float64 {
+	return float64(b.live()) / float64(b.m)
+}
+
+// live returns count of cells in use, some may be expired till next decay
+func (b *TTLBloomFilter) live() uint {
+	b.RLock()
+	defer b.RUnlock()
+
+	sum := uint(0)
+	for i := uint(0); i < b.m; i++ {
+		if b.buckets.Get(i) != 0 {
+			sum++
+		}
+	}
+	return sum
+}
+
+// PeriodMaintaince clears expired cells at every call, and dumps if forced
+func (b *TTLBloomFilter) PeriodMaintaince(persister FilterPersister, force bool) error {
+	b.Lock()
+	cleared := b.sweep(b.at(b.epoch(time.Now())))
+	b.Unlock()
+	log4go.Info("decay ttl bloom filter %s, cleared %d cells", b.name, cleared)
+
+	if force {
+		log4go.Info("period dump ttl bloom filter: %s", b.name)
+		return persistFilter(persister, b)
+	}
+
+	return nil
+}
+
+func (b *TTLBloomFilter) epoch(t time.Time) uint64 {
+	return uint64(t.UnixNano() / int64(b.ttl/TTL_EPOCHS))
+}
+
+// at returns e, or the epoch of latest add if it's later, as epochs are taken
+// before locking and a concurrent add may stamp cells of the next epoch, which
+// would look expired at e
+// this function is not thread safe
+func (b *TTLBloomFilter) at(e uint64) uint64 {
+	if e < b.latest {
+		return b.latest
+	}
+
+	return e
+}
+
+func stampOf(epoch uint64) uint32 {
+	return uint32(epoch%TTL_STAMPS) + 1
+}
+
+// age returns epochs passed since stamp v till stamp now
+func age(v, now uint32) uint32 {
+	return (now + TTL_STAMPS - v) % TTL_STAMPS
+}
+
+// decay clears cells older than ttl at epoch e, returns count of cleared
+// this function is not thread safe
+func (b *TTLBloomFilter) decay(e uint64) uint {
+	now := stampOf(e)
+	cleared := uint(0)
+	for i := uint(0); i < b.m; i++ {
+		if v := b.buckets.Get(i); v != 0 && age(v, now) > TTL_EPOCHS {
+			b.buckets.SetValue(i, 0)
+			cleared++
+		}
+	}
+
+	b.swept = e
+	return cleared
+}
+
+// lagged returns whether a decay step is needed before ages of cells can be
+// told at epoch e, if maintaince didn't run for long
+// this function is not thread safe
+func (b *TTLBloomFilter) lagged(e uint64) bool {
+	return e >= b.swept+TTL_SWEEP_EPOCHS
+}
+
+// sweep decays the filter at epoch e, returns count of cleared cells
+// this function is not thread safe
+func (b *TTLBloomFilter) sweep(e uint64) uint {
+	if !b.lagged(e) {
+		return b.decay(e)
+	}
+
+	// ages can't be told at e at once, but they can at the latest add, which
+	// was checked for lag, and cells left by then are young enough at e, or
+	// all expired
+	cleared := b.decay(b.latest)
+	if e > b.latest+TTL_EPOCHS {
+		cleared += b.decay(b.latest + TTL_EPOCHS + 1)
+		b.swept = e
+		return cleared
+	}
+
+	return cleared + b.decay(e)
+}
+
+func (b *TTLBloomFilter) Test(data []byte) bool {
+	return b.testAt(data, b.epoch(time.Now()))
+}
+
+// testAt tests data at epoch e
+func (b *TTLBloomFilter) testAt(data []byte, e uint64) bool {
+	b.RLock()
+	e = b.at(e)
+	if b.lagged(e) {
+		b.RUnlock()
+		b.Lock()
+		if b.lagged(e) {
+			b.sweep(e)
+		}
+		b.Unlock()
+		b.RLock()
+		e = b.at(e)
+	}
+	defer b.RUnlock()
+
+	return b.test(data, stampOf(e))
+}
+
+// test returns whether cells of data are all set within ttl
+// this function is not thread safe
+func (b *TTLBloomFilter) test(data []byte, now uint32) bool {
+	h1, h2 := hashKeys(b.hash, data)
+
+	for i := uint(0); i < b.k; i++ {
+		v := b.buckets.Get(location(h1, h2, i, b.m))
+		if v == 0 || age(v, now) > TTL_EPOCHS {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (b *TTLBloomFilter) Add(data []byte) Filter {
+	b.TestAndAdd(data)
+	return b
+}
+
+// TestAndAdd refreshes stamps of data, so its ttl restarts
+func (b *TTLBloomFilter) TestAndAdd(data []byte) bool {
+	return b.testAndAddAt(data, b.epoch(time.Now()))
+}
+
+// testAndAddAt adds data at epoch e, returns whether it existed
+func (b *TTLBloomFilter) testAndAddAt(data []byte, e uint64) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	e = b.at(e)
+	if b.lagged(e) {
+		b.sweep(e)
+	}
+	b.latest = e
+
+	now := stampOf(e)
+	exists := b.test(data, now)
+
+	h1, h2 := hashKeys(b.hash, data)
+	for i := uint(0); i < b.k; i++ {
+		b.buckets.SetValue(location(h1, h2, i, b.m), now)
+	}
+
+	return exists
+}
+
+func (b *TTLBloomFilter) Reset() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.buckets.Reset()
+}
+
+func (b *TTLBloomFilter) Load(stream io.Reader) error {
+	b.Lock()
+	defer b.Unlock()
+
+	r := newBinReader(stream)
+	t, meta := r.Section()
+	if r.err != nil || t != SECTION_TTL {
+		log4go.Warn("read ttl bloom filter header error")
+		return ILLEGAL_LOAD_FORMAT
+	}
+
+	b.name = meta.String()
+	b.m = uint(meta.U64())
+	b.k = uint(meta.U32())
+	b.errorRate = meta.F64()
+	b.hash = meta.U8()
+	b.ttl = time.Duration(meta.I64())
+	b.swept = meta.U64()
+	b.latest = meta.U64()
+	if hashName(b.hash) == "" || b.ttl < TTL_EPOCHS {
+		log4go.Warn("unknown hash kind %d or illegal ttl %v", b.hash, b.ttl)
+		return ILLEGAL_LOAD_FORMAT
+	}
+	b.buckets = &Buckets{}
+	log4go.Info("loaded ttl filter name:%s k:%d m:%d ttl:%v", b.name, b.k, b.m, b.ttl)
+
+	if err := b.buckets.Load(r); err != nil {
+		return err
+	}
+	if b.buckets.Count() != b.m || b.m == 0 || b.buckets.bucketSize != TTL_STAMP_BITS {
+		log4go.Warn("buckets count %d mismatch m %d", b.buckets.Count(), b.m)
+		return ILLEGAL_LOAD_FORMAT
+	}
+
+	if e := b.epoch(time.Now()); b.lagged(e) {
+		log4go.Warn("ttl filter %s was swept %d epochs ago, catch up", b.name, e-b.swept)
+		b.sweep(e)
+	}
+
+	return nil
+}
+
+func (b *TTLBloomFilter) Dump(stream io.Writer) error {
+	b.RLock()
+	defer b.RUnlock()
+
+	w := newBinWriter(stream)
+
+	w.Section(SECTION_TTL, func(meta *binWriter) {
+		meta.String(b.name)
+		meta.U64(uint64(b.m))
+		meta.U32(uint32(b.k))
+		meta.F64(b.errorRate)
+		meta.U8(b.hash)
+		meta.I64(int64(b.ttl))
+		meta.U64(b.swept)
+		meta.U64(b.latest)
+	})
+	if w.err != nil {
+		log4go.Warn("encode error: %v", w.err)
+		return w.err
+	}
+	log4go.Info("dumped ttl filter header with name:%s k:%d m:%d ttl:%v", b.name, b.k, b.m, b.ttl)
+
+	return b.buckets.Dump(w)
+}
@@ -0,0 +1,153 @@
+package bloom
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Ensures that keys live for ttl and at most one more epoch.
+func TestTTLBloomExpire(t *testing.T) {
+	fs, err := NewTTLBloomFilter(FilterOptions{Name: "test", N: 1000, ErrorRate: 0.01, TTL: 48 * time.Hour})
+	if err != nil {
+		t.Fatalf("create ttl filter error: %v", err)
+	}
+	f := fs.(*TTLBloomFilter)
+	e := f.swept
+
+	if f.testAndAddAt([]byte("a"), e) {
+		t.Error("`a` should not exist")
+	}
+	f.testAndAddAt([]byte("b"), e+TTL_EPOCHS/2)
+
+	if !f.testAt([]byte("a"), e+TTL_EPOCHS) || !f.testAt([]byte("b"), e+TTL_EPOCHS) {
+		t.Error("`a` and `b` should live for ttl")
+	}
+	if f.testAt([]byte("a"), e+TTL_EPOCHS+1) {
+		t.Error("`a` should expire after ttl")
+	}
+	if !f.testAt([]byte("b"), e+TTL_EPOCHS+1) {
+		t.Error("`b` should not expire")
+	}
+
+	// adding again restarts ttl
+	if !f.testAndAddAt([]byte("b"), e+TTL_EPOCHS) {
+		t.Error("`b` should exist")
+	}
+	if !f.testAt([]byte("b"), e+2*TTL_EPOCHS) || f.testAt([]byte("b"), e+2*TTL_EPOCHS+1) {
+		t.Error("`b` should live for ttl since added again")
+	}
+}
+
+// Ensures that decay clears expired cells, and a lagged filter decays before
+// stamps wrap around.
+func TestTTLBloomDecay(t *testing.T) {
+	fs, _ := NewTTLBloomFilter(FilterOptions{Name: "test", N: 1000, ErrorRate: 0.01, TTL: time.Hour})
+	f := fs.(*TTLBloomFilter)
+	e := f.swept
+
+	for i := 0; i < 100; i++ {
+		f.testAndAddAt([]byte(strconv.Itoa(i)), e)
+	}
+	for i := 100; i < 200; i++ {
+		f.testAndAddAt([]byte(strconv.Itoa(i)), e+10)
+	}
+
+	if count := f.Count(); count < 190 || count > 210 {
+		t.Errorf("Expected about 200 keys, got %d", count)
+	}
+
+	f.Lock()
+	cleared := f.decay(e + TTL_EPOCHS + 1)
+	f.Unlock()
+	if cleared == 0 {
+		t.Error("expired cells should be cleared")
+	}
+	if count := f.Count(); count < 90 || count > 110 {
+		t.Errorf("Expected about 100 keys, got %d", count)
+	}
+	for i := 100; i < 200; i++ {
+		if !f.testAt([]byte(strconv.Itoa(i)), e+TTL_EPOCHS+1) {
+			t.Errorf("%d should be a member", i)
+		}
+	}
+
+	// a stamp of a full period later equals the one of expired keys
+	wrapped := e + 10 + TTL_STAMPS
+	if f.testAt([]byte("100"), wrapped) {
+		t.Error("lagged filter should decay before stamps wrap")
+	}
+	if f.swept != wrapped || f.FillRatio() != 0 {
+		t.Errorf("lagged filter should be reset at %d, swept %d", wrapped, f.swept)
+	}
+
+	// lagged but keys added lately still live
+	e = wrapped
+	f.testAndAddAt([]byte("old"), e)
+	f.testAndAddAt([]byte("new"), e+TTL_SWEEP_EPOCHS-1)
+	if !f.testAt([]byte("new"), e+TTL_SWEEP_EPOCHS+TTL_EPOCHS-1) {
+		t.Error("`new` should live after lagged filter decayed")
+	}
+	if f.testAt([]byte("old"), e+TTL_SWEEP_EPOCHS+TTL_EPOCHS-1) || f.testAt([]byte("old"), e+TTL_STAMPS) {
+		t.Error("`old` should expire")
+	}
+}
+
+// Ensures that a key added at the next epoch by a concurrent add is a member
+// for tests taking epoch before it.
+func TestTTLBloomEpochBoundary(t *testing.T) {
+	fs, _ := NewTTLBloomFilter(FilterOptions{Name: "test", N: 1000, ErrorRate: 0.01, TTL: time.Hour})
+	f := fs.(*TTLBloomFilter)
+	e := f.swept
+
+	f.testAndAddAt([]byte("a"), e+1)
+	if !f.testAt([]byte("a"), e) {
+		t.Error("`a` added at next epoch should be a member")
+	}
+	if !f.testAndAddAt([]byte("a"), e) {
+		t.Error("`a` added at next epoch should exist")
+	}
+}
+
+// Ensures that ttl filter survives dump and load, and a stale dump is reset.
+func TestTTLBloomDumpLoad(t *testing.T) {
+	f, _ := NewTTLBloomFilter(FilterOptions{Name: "test", N: 1000, ErrorRate: 0.01, TTL: time.Hour, Hash: HASH_XXHASH})
+	for i := 0; i < 100; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	buf := &bytes.Buffer{}
+	if err := WriteDump(buf, f); err != nil {
+		t.Fatalf("dump error: %v", err)
+	}
+	data := buf.Bytes()
+
+	loaded, _, err := LoadDump(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("load error: %v", err)
+	}
+	l, ok := loaded.(*TTLBloomFilter)
+	if !ok {
+		t.Fatalf("expected ttl filter, got %s", filterType(loaded))
+	}
+	if l.Name() != "test" || l.TTL() != time.Hour || l.Capacity() != f.Capacity() || HashOf(l) != HASH_XXHASH {
+		t.Errorf("loaded filter mismatch, name:%s ttl:%v m:%d hash:%s", l.Name(), l.TTL(), l.Capacity(), HashOf(l))
+	}
+	for i := 0; i < 100; i++ {
+		if !l.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("%d should be a member", i)
+		}
+	}
+
+	f.(*TTLBloomFilter).swept -= TTL_SWEEP_EPOCHS
+	f.(*TTLBloomFilter).latest -= TTL_SWEEP_EPOCHS
+	buf = &bytes.Buffer{}
+	WriteDump(buf, f)
+	if loaded, _, err = LoadDump(buf); err != nil {
+		t.Fatalf("load error: %v", err)
+	}
+	if loaded.Test([]byte("1")) || loaded.FillRatio() != 0 {
+		t.Error("stale dump should be reset")
+	}
+}
@@ -0,0 +1,323 @@
+package bloom
+
+/*
+ *  @Describe: append-only log of add operations, replayed on top of the last dump
+ */
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alecthomas/log4go"
+)
+
+const (
+	LOG_OP_ADD    = byte(1)
+	LOG_OP_REMOVE = byte(2)
+
+	LOG_SUFFIX = ".wal"
+)
+
+var (
+	UseWAL = false
+)
+
+// AddLog is the write-ahead log of one filter, splitted into segments named
+// as name.<seq>.wal. Before dumping, the log is rolled to a new segment, and
+// segments before it are purged after the dump succeeded since the keys
+// in them are already in the snapshot.
+//
+// writers must hold the read lock across appending to the log and adding to
+// the filter, so a roll never happens between the two steps. Appends are
+// synced to disk before returning, concurrent ones share a sync.
+type AddLog struct {
+	sync.RWMutex
+
+	mu       sync.Mutex // protects f and written
+	basePath string
+	name     string
+	seq      int64
+	f        *os.File
+	written  int64 // bytes appended to all segments
+
+	syncMu sync.Mutex // protects synced
+	synced int64      // bytes of written synced to disk
+}
+
+func OpenAddLog(basePath, name string) (*AddLog, error) {
+	l := &AddLog{
+		basePath: basePath,
+		name:     name,
+	}
+
+	segments, err := l.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(segments) > 0 {
+		l.seq = segments[len(segments)-1] + 1
+	}
+
+	if err := l.openSegment(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *AddLog) segmentPath(seq int64) string {
+	return filepath.Join(l.basePath, l.name+"."+strconv.FormatInt(seq, 10)+LOG_SUFFIX)
+}
+
+// segments returns sequences of all segments in ascending order
+func (l *AddLog) segments() ([]int64, error) {
+	files, err := ioutil.ReadDir(l.basePath)
+	if err != nil {
+		log4go.Warn("read dir of %s error:%v", l.basePath, err)
+		return nil, err
+	}
+
+	ret := make([]int64, 0)
+	prefix := l.name + "."
+
+	for _, file := range files {
+		fileName := file.Name()
+		if !strings.HasPrefix(fileName, prefix) || !strings.HasSuffix(fileName, LOG_SUFFIX) {
+			continue
+		}
+
+		seq, err := strconv.ParseInt(fileName[len(prefix):len(fileName)-len(LOG_SUFFIX)], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		ret = append(ret, seq)
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret, nil
+}
+
+// this function is not thread safe
+func (l *AddLog) openSegment() error {
+	fullpath := l.segmentPath(l.seq)
+	f, err := os.OpenFile(fullpath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log4go.Warn("open log segment %s error: %v", fullpath, err)
+		return err
+	}
+
+	l.f = f
+	log4go.Info("opened log segment %s", fullpath)
+	return nil
+}
+
+func (l *AddLog) Append(op byte, keys []string) error {
+	size := 0
+	for _, key := range keys {
+		size += 1 + binary.MaxVarintLen64 + len(key)
+	}
+
+	buf := make([]byte, 0, size)
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	for _, key := range keys {
+		buf = append(buf, op)
+		buf = append(buf, lenBuf[:binary.PutUvarint(lenBuf, uint64(len(key)))]...)
+		buf = append(buf, key...)
+	}
+
+	l.mu.Lock()
+	if l.f == nil {
+		l.mu.Unlock()
+		return fmt.Errorf("log of %s closed", l.name)
+	}
+
+	if _, err := l.f.Write(buf); err != nil {
+		l.mu.Unlock()
+		log4go.Warn("append log of %s error: %v", l.name, err)
+		return err
+	}
+	l.written += int64(len(buf))
+	pos, f := l.written, l.f
+	l.mu.Unlock()
+
+	return l.sync(f, pos)
+}
+
+// sync syncs f up to pos, appends written meanwhile are synced together so
+// concurrent appends wait for one sync instead of one each
+func (l *AddLog) sync(f *os.File, pos int64) error {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+
+	if l.synced >= pos {
+		return nil
+	}
+
+	l.mu.Lock()
+	written := l.written
+	l.mu.Unlock()
+
+	if err := f.Sync(); err != nil {
+		log4go.Warn("sync log of %s error: %v", l.name, err)
+		return err
+	}
+
+	l.synced = written
+	return nil
+}
+
+// Roll starts a new segment, returns the sequence of the last finished segment
+func (l *AddLog) Roll() (int64, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.roll()
+}
+
+// Hold rolls the log like Roll and keeps appends blocked until Unlock, so
+// the filter has exactly keys of segments until the returned one meanwhile
+func (l *AddLog) Hold() (int64, error) {
+	l.Lock()
+
+	seq, err := l.roll()
+	if err != nil {
+		l.Unlock()
+	}
+
+	return seq, err
+}
+
+// this function is not thread safe
+func (l *AddLog) roll() (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f != nil {
+		l.f.Close()
+	}
+
+	last := l.seq
+	l.seq++
+
+	return last, l.openSegment()
+}
+
+// Purge removes all segments not after upto
+func (l *AddLog) Purge(upto int64) error {
+	segments, err := l.segments()
+	if err != nil {
+		return err
+	}
+
+	for _, seq := range segments {
+		if seq > upto {
+			break
+		}
+
+		if err := os.Remove(l.segmentPath(seq)); err != nil {
+			log4go.Warn("remove log segment %s error: %v", l.segmentPath(seq), err)
+			return err
+		}
+	}
+
+	log4go.Info("purged log of %s upto %d", l.name, upto)
+	return nil
+}
+
+// Replay calls fn with every logged operation of finished segments in order
+func (l *AddLog) Replay(fn func(op byte, key []byte)) (int, error) {
+	return l.ReplayFrom(0, fn)
+}
+
+// ReplayFrom replays finished segments from start, ones before it are in the
+// snapshot already
+func (l *AddLog) ReplayFrom(start int64, fn func(op byte, key []byte)) (int, error) {
+	segments, err := l.segments()
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, seq := range segments {
+		if seq < start {
+			continue
+		}
+		if seq >= l.seq {
+			break
+		}
+
+		n, err := replaySegment(l.segmentPath(seq), fn)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+func replaySegment(path string, fn func(op byte, key []byte)) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	n := 0
+
+	for {
+		op, err := reader.ReadByte()
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+
+		length, err := binary.ReadUvarint(reader)
+		if err != nil {
+			// last record may be partially written when crashed
+			log4go.Warn("truncated record in %s after %d records", path, n)
+			return n, nil
+		}
+
+		key := make([]byte, length)
+		if _, err := io.ReadFull(reader, key); err != nil {
+			log4go.Warn("truncated record in %s after %d records", path, n)
+			return n, nil
+		}
+
+		fn(op, key)
+		n++
+	}
+}
+
+func (l *AddLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// Destroy closes the log and removes all segments
+func (l *AddLog) Destroy() error {
+	l.Close()
+	return l.Purge(l.seq)
+}
@@ -0,0 +1,271 @@
+package bloom
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAddLogReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bfserver")
+	if err != nil {
+		t.Errorf("create temp dir error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := OpenAddLog(dir, "test")
+	if err != nil {
+		t.Errorf("open log error: %v", err)
+		return
+	}
+
+	l.Append(LOG_OP_ADD, []string{"a", "b", ""})
+	seq, err := l.Roll()
+	if err != nil {
+		t.Errorf("roll log error: %v", err)
+		return
+	}
+	l.Append(LOG_OP_REMOVE, []string{"a"})
+	l.Close()
+
+	// reopen as recovering after crash
+	l, err = OpenAddLog(dir, "test")
+	if err != nil {
+		t.Errorf("open log error: %v", err)
+		return
+	}
+	defer l.Close()
+
+	ops := make([]byte, 0)
+	keys := make([]string, 0)
+	n, err := l.Replay(func(op byte, key []byte) {
+		ops = append(ops, op)
+		keys = append(keys, string(key))
+	})
+	if err != nil || n != 4 {
+		t.Errorf("replay error: %v, replayed %d", err, n)
+		return
+	}
+
+	if keys[0] != "a" || keys[1] != "b" || keys[2] != "" || keys[3] != "a" || ops[2] != LOG_OP_ADD || ops[3] != LOG_OP_REMOVE {
+		t.Errorf("replay content error: %v %v", ops, keys)
+	}
+
+	if err := l.Purge(seq); err != nil {
+		t.Errorf("purge error: %v", err)
+	}
+
+	n, _ = l.Replay(func(op byte, key []byte) {})
+	if n != 1 {
+		t.Errorf("expected 1 record after purge, got %d", n)
+	}
+}
+
+func TestRecoverWithLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bfserver")
+	if err != nil {
+		t.Errorf("create temp dir error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	UseWAL = true
+	defer func() { UseWAL = false }()
+
+	p, _ := NewLocalFileFilterPersister(dir, RetentionPolicy{})
+	m, _ := NewFilterManager(p, 6000)
+	m.AddNewBloomFilter(FILTER_COUNTING, FilterOptions{Name: "test", N: 1000, ErrorRate: 0.001})
+
+	m.AddKeys("test", []string{"a", "b"}, true)
+	if err := m.DumpFilter("test"); err != nil {
+		t.Errorf("dump filter error: %v", err)
+		return
+	}
+	m.AddKeys("test", []string{"c"}, true)
+	m.RemoveKeys("test", []string{"a"})
+
+	// recover from the dump and the log, without dump after the last add
+	p, _ = NewLocalFileFilterPersister(dir, RetentionPolicy{})
+	other, _ := NewFilterManager(p, 6000)
+	if err := other.RecoverFilters(); err != nil {
+		t.Errorf("recover filters error: %v", err)
+		return
+	}
+
+	f, err := other.GetBloomFilter("test")
+	if err != nil {
+		t.Errorf("get filter error: %v", err)
+		return
+	}
+
+	if f.Test([]byte("a")) || !f.Test([]byte("b")) || !f.Test([]byte("c")) {
+		t.Errorf("recovered filter error")
+	}
+}
+
+// Ensures that a filter whose log fails to replay is recovered from its snapshot.
+func TestRecoverWithBrokenLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bfserver")
+	if err != nil {
+		t.Errorf("create temp dir error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	UseWAL = true
+	defer func() { UseWAL = false }()
+
+	p, _ := NewLocalFileFilterPersister(dir, RetentionPolicy{})
+	m, _ := NewFilterManager(p, 6000)
+	m.AddNewBloomFilter(FILTER_CLASSIC, FilterOptions{Name: "test", N: 1000, ErrorRate: 0.001})
+	m.AddKeys("test", []string{"a"}, true)
+	if err := m.DumpFilter("test"); err != nil {
+		t.Errorf("dump filter error: %v", err)
+		return
+	}
+
+	// a segment which can't be read, after the one rolled by the dump
+	os.Mkdir(filepath.Join(dir, "test.5"+LOG_SUFFIX), 0755)
+
+	p, _ = NewLocalFileFilterPersister(dir, RetentionPolicy{})
+	other, _ := NewFilterManager(p, 6000)
+	other.RecoverFilters()
+
+	f, err := other.GetBloomFilter("test")
+	if err != nil {
+		t.Errorf("filter should be recovered from snapshot: %v", err)
+		return
+	}
+	if !f.Test([]byte("a")) {
+		t.Errorf("key of snapshot should be a member")
+	}
+
+	if err := other.AddKeys("test", []string{"b"}, true); err != nil || other.logs["test"] == nil {
+		t.Errorf("adds should still be logged: %v", err)
+	}
+}
+
+// Ensures that segments in the snapshot aren't replayed again, even if they
+// weren't purged after the dump.
+func TestRecoverWithUnpurgedLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bfserver")
+	if err != nil {
+		t.Errorf("create temp dir error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	UseWAL = true
+	defer func() { UseWAL = false }()
+
+	p, _ := NewLocalFileFilterPersister(dir, RetentionPolicy{})
+	m, _ := NewFilterManager(p, 6000)
+	m.AddNewBloomFilter(FILTER_COUNTING, FilterOptions{Name: "test", N: 1000, ErrorRate: 0.001})
+	m.AddKeys("test", []string{"a"}, true)
+
+	segment := filepath.Join(dir, "test.0"+LOG_SUFFIX)
+	logged, _ := ioutil.ReadFile(segment)
+	if err := m.DumpFilter("test"); err != nil {
+		t.Errorf("dump filter error: %v", err)
+		return
+	}
+
+	// as crashed before purging
+	ioutil.WriteFile(segment, logged, 0644)
+
+	p, _ = NewLocalFileFilterPersister(dir, RetentionPolicy{})
+	other, _ := NewFilterManager(p, 6000)
+	other.RecoverFilters()
+
+	f, _ := other.GetBloomFilter("test")
+	if f == nil || !f.Test([]byte("a")) {
+		t.Errorf("key of snapshot should be a member")
+		return
+	}
+	if f.(RemovableFilter).Remove([]byte("a")); f.Test([]byte("a")) {
+		t.Errorf("key of snapshot should be added once")
+	}
+}
+
+// Ensures that logged adds wait for a held dump.
+func TestLoggedWriterHold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bfserver")
+	if err != nil {
+		t.Errorf("create temp dir error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	UseWAL = true
+	defer func() { UseWAL = false }()
+
+	p, _ := NewLocalFileFilterPersister(dir, RetentionPolicy{})
+	m, _ := NewFilterManager(p, 6000)
+	f, _ := m.AddNewBloomFilter(FILTER_COUNTING, FilterOptions{Name: "test", N: 1000, ErrorRate: 0.001})
+
+	w, _ := m.persisterOf(f).NewWriter("test")
+	if err := w.(LoggedWriter).Hold(); err != nil {
+		t.Errorf("hold error: %v", err)
+		return
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- m.AddKeys("test", []string{"a"}, true)
+	}()
+
+	select {
+	case <-done:
+		t.Errorf("add should wait for the held dump")
+		return
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	w.Abort()
+	if err := <-done; err != nil || !f.Test([]byte("a")) {
+		t.Errorf("add after dump error: %v", err)
+	}
+}
+
+// Ensures that log of the filter before reload isn't replayed over the
+// reloaded one.
+func TestRecoverAfterReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bfserver")
+	if err != nil {
+		t.Errorf("create temp dir error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	UseWAL = true
+	defer func() { UseWAL = false }()
+
+	reloaded, _ := NewCountingBloomFilter(FilterOptions{Name: "test", N: 1000, ErrorRate: 0.001})
+	reloaded.Add([]byte("c"))
+	path := filepath.Join(dir, "reloaded")
+	file, _ := os.Create(path)
+	WriteDump(file, reloaded)
+	file.Close()
+
+	p, _ := NewLocalFileFilterPersister(dir, RetentionPolicy{})
+	m, _ := NewFilterManager(p, 6000)
+	m.AddNewBloomFilter(FILTER_COUNTING, FilterOptions{Name: "test", N: 1000, ErrorRate: 0.001})
+	m.AddKeys("test", []string{"b"}, true)
+	if err := m.ReloadFilter("test", path); err != nil {
+		t.Errorf("reload filter error: %v", err)
+		return
+	}
+	m.AddKeys("test", []string{"d"}, true)
+
+	p, _ = NewLocalFileFilterPersister(dir, RetentionPolicy{})
+	other, _ := NewFilterManager(p, 6000)
+	other.RecoverFilters()
+
+	f, _ := other.GetBloomFilter("test")
+	if f == nil || f.Test([]byte("b")) || !f.Test([]byte("c")) || !f.Test([]byte("d")) {
+		t.Errorf("recovered filter should be the reloaded one and keys added after")
+	}
+}
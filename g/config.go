@@ -20,7 +20,13 @@ type Configuration struct {
 		Path             string `json:"path"`
 		UseGzip          bool   `json:"use_gzip"`
 		ForceDumpSeconds int    `json:"force_dump_seconds"`
+		UseWAL           bool   `json:"use_wal"`
+		KeepSnapshots    int    `json:"keep_snapshots"`
+		SnapshotMaxAge   int    `json:"snapshot_max_age_seconds"`
 	} `json:"persist"`
+	Batch struct {
+		Workers int `json:"workers"` // worker pool size of batch operations, 0 for number of cpus
+	} `json:"batch"`
 	Rpc struct {
 		BF struct {
 			Addr string `json:"addr"`
@@ -30,6 +36,11 @@ type Configuration struct {
 		Enabled bool   `json:"enabled"`
 		Addr    string `json:"addr"`
 	} `json:"gprof"`
+	Metrics struct {
+		Enabled bool   `json:"enabled"`
+		Addr    string `json:"addr"`
+		Path    string `json:"path"` // "/metrics" if empty
+	} `json:"metrics"`
 }
 
 func load_conf() bool {
@@ -0,0 +1,454 @@
+package metrics
+
+/*
+ *  @Describe: minimal metrics in prometheus text exposition format
+ *
+ *  Metrics are created once as package level vars and registered to the
+ *  default registry, each is a vector keyed by its label values. Gauges
+ *  derived from state, like filter sizes, are set by collectors which run
+ *  before every scrape.
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	TYPE_COUNTER   = "counter"
+	TYPE_GAUGE     = "gauge"
+	TYPE_HISTOGRAM = "histogram"
+
+	CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+	labelSep = "\xff"
+)
+
+var (
+	// DEFAULT_BUCKETS are upper bounds in seconds, 100us to about 26s
+	DEFAULT_BUCKETS = ExponentialBuckets(0.0001, 4, 10)
+
+	Default = NewRegistry()
+
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+type Registry struct {
+	sync.Mutex
+
+	metrics    []metric
+	names      map[string]bool
+	collectors []func()
+
+	// held through collecting and writing, so collectors of a concurrent
+	// scrape don't reset gauges being written
+	scraping sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) register(m metric) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.names[m.name()] {
+		panic(fmt.Sprintf("duplicated metric %s", m.name()))
+	}
+
+	r.names[m.name()] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// RegisterCollector adds fn which is called before every scrape
+func (r *Registry) RegisterCollector(fn func()) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.collectors = append(r.collectors, fn)
+}
+
+// Expose runs collectors then writes all metrics sorted by name
+func (r *Registry) Expose(w io.Writer) error {
+	r.scraping.Lock()
+	defer r.scraping.Unlock()
+
+	r.Lock()
+	collectors := append([]func(){}, r.collectors...)
+	metrics := append([]metric{}, r.metrics...)
+	r.Unlock()
+
+	for _, fn := range collectors {
+		fn()
+	}
+
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name() < metrics[j].name() })
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+
+	return bw.Flush()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE)
+	r.Expose(w)
+}
+
+func RegisterCollector(fn func()) {
+	Default.RegisterCollector(fn)
+}
+
+// Handler serves metrics of the default registry
+func Handler() http.Handler {
+	return Default
+}
+
+// ExponentialBuckets returns count bounds from start, each factor times the last
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+
+	return buckets
+}
+
+// vec keeps children by label values, they are created on first use
+type vec struct {
+	sync.RWMutex
+
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+	children   map[string]interface{}
+	newChild   func() interface{}
+}
+
+func (v *vec) name() string {
+	return v.metricName
+}
+
+func (v *vec) child(values []string) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.metricName, len(v.labels), len(values)))
+	}
+
+	key := strings.Join(values, labelSep)
+
+	v.RLock()
+	c, ok := v.children[key]
+	v.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.Lock()
+	defer v.Unlock()
+	if c, ok = v.children[key]; !ok {
+		c = v.newChild()
+		v.children[key] = c
+	}
+
+	return c
+}
+
+// Delete drops the child of values, e.g. of a deleted filter
+func (v *vec) Delete(values ...string) {
+	v.Lock()
+	defer v.Unlock()
+
+	delete(v.children, strings.Join(values, labelSep))
+}
+
+// DeleteMatching drops children whose label is value
+func (v *vec) DeleteMatching(label, value string) {
+	v.Lock()
+	defer v.Unlock()
+
+	for i, l := range v.labels {
+		if l != label {
+			continue
+		}
+
+		for key := range v.children {
+			if strings.Split(key, labelSep)[i] == value {
+				delete(v.children, key)
+			}
+		}
+	}
+}
+
+// lookup returns the child of values without creating it
+func (v *vec) lookup(values []string) (interface{}, bool) {
+	v.RLock()
+	defer v.RUnlock()
+
+	c, ok := v.children[strings.Join(values, labelSep)]
+	return c, ok
+}
+
+// Reset drops all children
+func (v *vec) Reset() {
+	v.Lock()
+	defer v.Unlock()
+
+	v.children = make(map[string]interface{})
+}
+
+// each calls fn with label pairs of children sorted by values
+func (v *vec) each(fn func(labels string, c interface{})) {
+	v.RLock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	children := make([]interface{}, len(keys))
+	sort.Strings(keys)
+	for i, key := range keys {
+		children[i] = v.children[key]
+	}
+	v.RUnlock()
+
+	for i, key := range keys {
+		values := strings.Split(key, labelSep)
+		if len(v.labels) == 0 {
+			values = nil
+		}
+
+		pairs := make([]string, len(values))
+		for j, value := range values {
+			pairs[j] = v.labels[j] + `="` + labelEscaper.Replace(value) + `"`
+		}
+
+		fn(strings.Join(pairs, ","), children[i])
+	}
+}
+
+func (v *vec) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.metricName, strings.Replace(v.help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.metricName, v.kind)
+}
+
+func newVec(name, help, kind string, labels []string, newChild func() interface{}) *vec {
+	return &vec{
+		metricName: name,
+		help:       help,
+		kind:       kind,
+		labels:     labels,
+		children:   make(map[string]interface{}),
+		newChild:   newChild,
+	}
+}
+
+func writeSample(w *bufio.Writer, name, labels string, value float64) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+type value struct {
+	sync.Mutex
+	v float64
+}
+
+func (v *value) add(delta float64) {
+	v.Lock()
+	v.v += delta
+	v.Unlock()
+}
+
+func (v *value) set(x float64) {
+	v.Lock()
+	v.v = x
+	v.Unlock()
+}
+
+func (v *value) get() float64 {
+	v.Lock()
+	defer v.Unlock()
+	return v.v
+}
+
+type CounterVec struct {
+	*vec
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, TYPE_COUNTER, labels, func() interface{} { return &value{} })}
+	Default.register(c)
+	return c
+}
+
+func (c *CounterVec) Add(delta float64, values ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("counter %s can't decrease", c.metricName))
+	}
+
+	c.child(values).(*value).add(delta)
+}
+
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Value returns zero if no values were added
+func (c *CounterVec) Value(values ...string) float64 {
+	if child, ok := c.lookup(values); ok {
+		return child.(*value).get()
+	}
+
+	return 0
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.each(func(labels string, child interface{}) {
+		writeSample(w, c.metricName, labels, child.(*value).get())
+	})
+}
+
+type GaugeVec struct {
+	*vec
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newVec(name, help, TYPE_GAUGE, labels, func() interface{} { return &value{} })}
+	Default.register(g)
+	return g
+}
+
+func (g *GaugeVec) Set(x float64, values ...string) {
+	g.child(values).(*value).set(x)
+}
+
+func (g *GaugeVec) Add(delta float64, values ...string) {
+	g.child(values).(*value).add(delta)
+}
+
+func (g *GaugeVec) Value(values ...string) float64 {
+	if child, ok := g.lookup(values); ok {
+		return child.(*value).get()
+	}
+
+	return 0
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	g.each(func(labels string, child interface{}) {
+		writeSample(w, g.metricName, labels, child.(*value).get())
+	})
+}
+
+type histogram struct {
+	sync.Mutex
+
+	counts []uint64 // not cumulative, the last one is of +Inf
+	sum    float64
+	count  uint64
+}
+
+type HistogramVec struct {
+	*vec
+	buckets []float64
+}
+
+// NewHistogramVec creates histogram of ascending upper bounds, DEFAULT_BUCKETS if nil
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DEFAULT_BUCKETS
+	}
+
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("buckets of histogram %s are not sorted", name))
+	}
+
+	h := &HistogramVec{buckets: buckets}
+	h.vec = newVec(name, help, TYPE_HISTOGRAM, labels, func() interface{} {
+		return &histogram{counts: make([]uint64, len(buckets)+1)}
+	})
+	Default.register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(x float64, values ...string) {
+	child := h.child(values).(*histogram)
+	i := sort.SearchFloat64s(h.buckets, x)
+
+	child.Lock()
+	child.counts[i]++
+	child.sum += x
+	child.count++
+	child.Unlock()
+}
+
+// Count returns number of observations
+func (h *HistogramVec) Count(values ...string) uint64 {
+	c, ok := h.lookup(values)
+	if !ok {
+		return 0
+	}
+
+	child := c.(*histogram)
+	child.Lock()
+	defer child.Unlock()
+	return child.count
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	h.each(func(labels string, c interface{}) {
+		child := c.(*histogram)
+		child.Lock()
+		counts := append([]uint64{}, child.counts...)
+		sum, count := child.sum, child.count
+		child.Unlock()
+
+		sep := ""
+		if labels != "" {
+			sep = ","
+		}
+
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += counts[i]
+			writeSample(w, h.metricName+"_bucket", labels+sep+`le="`+formatFloat(bound)+`"`, float64(cumulative))
+		}
+		writeSample(w, h.metricName+"_bucket", labels+sep+`le="+Inf"`, float64(count))
+		writeSample(w, h.metricName+"_sum", labels, sum)
+		writeSample(w, h.metricName+"_count", labels, float64(count))
+	})
+}
@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var (
+	testCounter   = NewCounterVec("test_requests_total", "test requests", "method", "filter")
+	testGauge     = NewGaugeVec("test_keys", "test keys")
+	testHistogram = NewHistogramVec("test_duration_seconds", "test duration", []float64{0.1, 1}, "method")
+)
+
+func scrape(t *testing.T) string {
+	buffer := new(bytes.Buffer)
+	if err := Default.Expose(buffer); err != nil {
+		t.Errorf("write metrics error: %v", err)
+	}
+
+	return buffer.String()
+}
+
+// Ensures that metrics are written in prometheus text format.
+func TestWriteMetrics(t *testing.T) {
+	testCounter.Inc("Add", "a")
+	testCounter.Add(2, "Add", `b"\`)
+	testGauge.Set(42)
+	testHistogram.Observe(0.05, "Test")
+	testHistogram.Observe(0.5, "Test")
+	testHistogram.Observe(5, "Test")
+
+	out := scrape(t)
+	for _, line := range []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{method="Add",filter="a"} 1`,
+		`test_requests_total{method="Add",filter="b\"\\"} 2`,
+		"# TYPE test_keys gauge",
+		"test_keys 42",
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{method="Test",le="0.1"} 1`,
+		`test_duration_seconds_bucket{method="Test",le="1"} 2`,
+		`test_duration_seconds_bucket{method="Test",le="+Inf"} 3`,
+		`test_duration_seconds_sum{method="Test"} 5.55`,
+		`test_duration_seconds_count{method="Test"} 3`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("expected line %s in:\n%s", line, out)
+		}
+	}
+
+	if strings.Index(out, "test_duration_seconds") > strings.Index(out, "test_keys") {
+		t.Errorf("metrics should be sorted by name")
+	}
+}
+
+// Ensures that collectors run on scrape and deleted children are dropped.
+func TestCollectorDelete(t *testing.T) {
+	gauge := NewGaugeVec("test_collected", "test collected", "filter")
+	RegisterCollector(func() {
+		gauge.Reset()
+		gauge.Set(1, "x")
+	})
+
+	if out := scrape(t); !strings.Contains(out, `test_collected{filter="x"} 1`) {
+		t.Errorf("collector should set gauge on scrape")
+	}
+
+	testCounter.Inc("Test", "c")
+	testCounter.Inc("Add", "c")
+	testCounter.DeleteMatching("filter", "c")
+	if testCounter.Value("Test", "c") != 0 || testCounter.Value("Add", "c") != 0 {
+		t.Errorf("children of filter c should be deleted")
+	}
+
+	if out := scrape(t); strings.Contains(out, `filter="c"`) {
+		t.Errorf("deleted children should not be written")
+	}
+}
+
+// Ensures that concurrent scrapes don't write gauges reset by each other.
+func TestConcurrentScrapes(t *testing.T) {
+	gauge := NewGaugeVec("test_scraped", "test scraped", "filter")
+	RegisterCollector(func() {
+		gauge.Reset()
+		gauge.Set(1, "x")
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if out := scrape(t); !strings.Contains(out, `test_scraped{filter="x"} 1`) {
+					t.Errorf("gauge should be written in every scrape")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/AgilaNews/bfserver/bloom"
 	g "github.com/AgilaNews/bfserver/g"
+	"github.com/AgilaNews/bfserver/metrics"
 	"github.com/AgilaNews/bfserver/service"
 	"github.com/alecthomas/log4go"
 	"net/http"
@@ -23,10 +24,17 @@ func main() {
 	defer log4go.Global.Close()
 
 	bloom.UseGzip = g.Config.Persist.UseGzip
+	bloom.UseWAL = g.Config.Persist.UseWAL
+	if g.Config.Batch.Workers > 0 {
+		bloom.BatchWorkers = g.Config.Batch.Workers
+	}
 	log4go.Info("current cpu: %d", runtime.NumCPU())
 	rand.Seed(time.Now().UTC().UnixNano())
 
-	persister, err := bloom.NewLocalFileFilterPersister(g.Config.Persist.Path)
+	persister, err := bloom.NewLocalFileFilterPersister(g.Config.Persist.Path, bloom.RetentionPolicy{
+		Keep:   g.Config.Persist.KeepSnapshots,
+		MaxAge: time.Duration(g.Config.Persist.SnapshotMaxAge) * time.Second,
+	})
 	if err != nil {
 		log4go.Crashf("open persister erorr")
 	}
@@ -76,6 +84,22 @@ func main() {
 			http.ListenAndServe(g.Config.Gprof.Addr, nil)
 		}()
 	}
+
+	if g.Config.Metrics.Enabled {
+		path := g.Config.Metrics.Path
+		if path == "" {
+			path = "/metrics"
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle(path, metrics.Handler())
+		go func() {
+			log4go.Info("metrics listen on %s%s", g.Config.Metrics.Addr, path)
+			if err := http.ListenAndServe(g.Config.Metrics.Addr, mux); err != nil {
+				log4go.Warn("metrics listen on %s error: %v", g.Config.Metrics.Addr, err)
+			}
+		}()
+	}
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
 OUTFOR:
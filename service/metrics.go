@@ -0,0 +1,178 @@
+package service
+
+import (
+	"path"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/AgilaNews/bfserver/bloom"
+	pb "github.com/AgilaNews/bfserver/bloomiface"
+	"github.com/AgilaNews/bfserver/metrics"
+)
+
+var (
+	rpcRequests = metrics.NewCounterVec("bfserver_rpc_requests_total",
+		"rpc requests by method and filter", "method", "filter")
+	rpcErrors = metrics.NewCounterVec("bfserver_rpc_errors_total",
+		"rpc requests returned error by method and filter", "method", "filter")
+	rpcDuration = metrics.NewHistogramVec("bfserver_rpc_duration_seconds",
+		"rpc latency by method and filter", nil, "method", "filter")
+
+	keysAdded = metrics.NewCounterVec("bfserver_keys_added_total",
+		"keys added to filter, existed ones excluded by test and add", "filter")
+	keysTested = metrics.NewCounterVec("bfserver_keys_tested_total",
+		"keys tested against filter", "filter")
+	keysPositive = metrics.NewCounterVec("bfserver_keys_positive_total",
+		"tested keys which were members of filter", "filter")
+
+	filterKeys = metrics.NewGaugeVec("bfserver_filter_keys",
+		"keys in filter", "filter", "type")
+	filterCapacity = metrics.NewGaugeVec("bfserver_filter_capacity",
+		"capacity of filter", "filter", "type")
+	filterStorage = metrics.NewGaugeVec("bfserver_filter_storage_bytes",
+		"memory used by filter", "filter", "type")
+	filterFillRatio = metrics.NewGaugeVec("bfserver_filter_fill_ratio",
+		"ratio of set buckets in filter", "filter", "type")
+	filterEstimatedFillRatio = metrics.NewGaugeVec("bfserver_filter_estimated_fill_ratio",
+		"fill ratio estimated by keys in filter", "filter", "type")
+	filterPositiveRatio = metrics.NewGaugeVec("bfserver_filter_positive_ratio",
+		"ratio of tested keys which were members of filter", "filter")
+
+	managerFilters = metrics.NewGaugeVec("bfserver_manager_filters",
+		"filters in manager")
+	managerKeys = metrics.NewGaugeVec("bfserver_manager_keys",
+		"keys of all filters in manager")
+	managerStorage = metrics.NewGaugeVec("bfserver_manager_storage_bytes",
+		"memory used by all filters in manager")
+
+	// held by collectFilters, so concurrent scrapes don't see gauges reset
+	// by each other
+	collectLock sync.Mutex
+)
+
+// namedRequest is request of a single filter
+type namedRequest interface {
+	GetName() string
+}
+
+// filterLabel returns name only if it's a filter of manager, so unknown
+// names in requests don't grow the label values
+func filterLabel(manager *bloom.FilterManager, name string) string {
+	if name == "" {
+		return ""
+	}
+
+	if _, err := manager.GetBloomFilter(name); err != nil {
+		return ""
+	}
+
+	return name
+}
+
+func observeRPC(manager *bloom.FilterManager, method, name string, d time.Duration, err error) {
+	filter := filterLabel(manager, name)
+
+	rpcRequests.Inc(method, filter)
+	rpcDuration.Observe(d.Seconds(), method, filter)
+	if err != nil {
+		rpcErrors.Inc(method, filter)
+	}
+}
+
+func unaryMetrics(manager *bloom.FilterManager) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		t := StartTimer()
+		resp, err := handler(ctx, req)
+
+		name := ""
+		if r, ok := req.(namedRequest); ok {
+			name = r.GetName()
+		} else if r, ok := req.(*pb.MergeRequest); ok {
+			name = r.Target
+		}
+
+		observeRPC(manager, path.Base(info.FullMethod), name, t.Stop(), err)
+		return resp, err
+	}
+}
+
+// namedStream keeps filter name of the first request received
+type namedStream struct {
+	grpc.ServerStream
+	name string
+}
+
+func (s *namedStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if r, ok := m.(namedRequest); ok && err == nil && s.name == "" {
+		s.name = r.GetName()
+	}
+
+	return err
+}
+
+func streamMetrics(manager *bloom.FilterManager) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		t := StartTimer()
+		stream := &namedStream{ServerStream: ss}
+		err := handler(srv, stream)
+
+		observeRPC(manager, path.Base(info.FullMethod), stream.name, t.Stop(), err)
+		return err
+	}
+}
+
+func observeAdded(name string, keys int) {
+	keysAdded.Add(float64(keys), name)
+}
+
+func observeTested(name string, keys, exists int) {
+	keysTested.Add(float64(keys), name)
+	keysPositive.Add(float64(exists), name)
+}
+
+// forgetFilterMetrics drops metrics of a deleted filter
+func forgetFilterMetrics(name string) {
+	keysAdded.Delete(name)
+	keysTested.Delete(name)
+	keysPositive.Delete(name)
+
+	rpcRequests.DeleteMatching("filter", name)
+	rpcErrors.DeleteMatching("filter", name)
+	rpcDuration.DeleteMatching("filter", name)
+}
+
+// collectFilters sets filter and manager gauges on scrape, fill ratios are
+// cached by manager as they scan all buckets
+func collectFilters(manager *bloom.FilterManager) {
+	collectLock.Lock()
+	defer collectLock.Unlock()
+
+	infos := manager.CachedFilterInfos()
+
+	for _, gauge := range []*metrics.GaugeVec{filterKeys, filterCapacity, filterStorage, filterFillRatio, filterEstimatedFillRatio, filterPositiveRatio} {
+		gauge.Reset()
+	}
+
+	keys, storage := uint64(0), uint64(0)
+	for _, info := range infos {
+		filterKeys.Set(float64(info.Count), info.Name, info.Type)
+		filterCapacity.Set(float64(info.Capacity), info.Name, info.Type)
+		filterStorage.Set(float64(info.Storage), info.Name, info.Type)
+		filterFillRatio.Set(info.FillRatio, info.Name, info.Type)
+		filterEstimatedFillRatio.Set(info.EstimatedFillRatio, info.Name, info.Type)
+		if tested := keysTested.Value(info.Name); tested > 0 {
+			filterPositiveRatio.Set(keysPositive.Value(info.Name)/tested, info.Name)
+		}
+
+		keys += uint64(info.Count)
+		storage += info.Storage
+	}
+
+	managerFilters.Set(float64(len(infos)))
+	managerKeys.Set(float64(keys))
+	managerStorage.Set(float64(storage))
+}
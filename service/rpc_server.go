@@ -6,6 +6,7 @@ import (
 
 	"github.com/AgilaNews/bfserver/bloom"
 	pb "github.com/AgilaNews/bfserver/bloomiface"
+	"github.com/AgilaNews/bfserver/metrics"
 	"github.com/alecthomas/log4go"
 	"google.golang.org/grpc"
 )
@@ -25,7 +26,11 @@ func NewBloomFilterServer(addr string, manager *bloom.FilterManager) (*BloomFilt
 
 	log4go.Info("listened on rpc server :%s success", addr)
 
-	c.rpcServer = grpc.NewServer()
+	c.rpcServer = grpc.NewServer(
+		grpc.UnaryInterceptor(unaryMetrics(manager)),
+		grpc.StreamInterceptor(streamMetrics(manager)),
+	)
+	metrics.RegisterCollector(func() { collectFilters(manager) })
 
 	service, _ := NewBloomFilterService(manager)
 	log4go.Info("registering rpc service")
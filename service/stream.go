@@ -0,0 +1,118 @@
+package service
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/AgilaNews/bfserver/bloom"
+	pb "github.com/AgilaNews/bfserver/bloomiface"
+	"github.com/alecthomas/log4go"
+)
+
+const (
+	STREAM_PROGRESS_KEYS = 1000000 // log progress of stream every such keys
+)
+
+// streamName returns filter name of the stream, only the first request must
+// carry the name
+func streamName(name, reqName string) (string, error) {
+	if name == "" {
+		name = reqName
+	} else if reqName != "" && reqName != name {
+		return "", fmt.Errorf("filter name changed from %s to %s in stream", name, reqName)
+	}
+
+	if len(name) == 0 {
+		return "", fmt.Errorf("empty request name")
+	}
+
+	return name, nil
+}
+
+func (b *BloomFilterService) AddStream(stream pb.BloomFilterService_AddStreamServer) error {
+	t := StartTimer()
+	resp := &pb.AddStreamResponse{}
+	name := ""
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			log4go.Info("%s add stream of %d requests, %d keys, duration:%v", name, resp.Requests, resp.Keys, t.Stop())
+			return stream.SendAndClose(resp)
+		} else if err != nil {
+			log4go.Warn("receive add stream of [%s] error: %v", name, err)
+			return err
+		}
+
+		if name, err = streamName(name, req.Name); err != nil {
+			return err
+		}
+
+		resp.Requests++
+		if len(req.Keys) == 0 {
+			continue
+		}
+
+		if err := b.Manager.AddKeys(name, req.Keys, !req.Async); err != nil {
+			log4go.Warn("add keys to bloomfilter name [%s] error: %v", name, err)
+			return err
+		}
+
+		observeAdded(name, len(req.Keys))
+		before := resp.Keys / STREAM_PROGRESS_KEYS
+		resp.Keys += uint64(len(req.Keys))
+		if resp.Keys/STREAM_PROGRESS_KEYS != before {
+			log4go.Info("%s add stream progress, %d keys, duration:%v", name, resp.Keys, t.Stop())
+		}
+	}
+}
+
+func (b *BloomFilterService) TestStream(stream pb.BloomFilterService_TestStreamServer) error {
+	t := StartTimer()
+	tested, existed := uint64(0), uint64(0)
+	name := ""
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			log4go.Info("%s test stream of %d keys, left:%d duration:%v", name, tested, tested-existed, t.Stop())
+			return nil
+		} else if err != nil {
+			log4go.Warn("receive test stream of [%s] error: %v", name, err)
+			return err
+		}
+
+		if name, err = streamName(name, req.Name); err != nil {
+			return err
+		}
+
+		filter, err := b.Manager.GetBloomFilter(name)
+		if err != nil {
+			log4go.Warn("get bloomfilter name [%s] error", name)
+			return err
+		}
+
+		if filter, err = scopeFilter(filter, req); err != nil {
+			log4go.Warn("scope bloomfilter name [%s] error: %v", name, err)
+			return err
+		}
+
+		resp := &pb.TestStreamResponse{}
+		exists := 0
+		resp.Exists, exists = bloom.BatchTest(filter, req.Keys)
+		observeTested(name, len(req.Keys), exists)
+
+		before := tested / STREAM_PROGRESS_KEYS
+		tested += uint64(len(req.Keys))
+		existed += uint64(exists)
+		resp.Tested, resp.Existed = tested, existed
+		if tested/STREAM_PROGRESS_KEYS != before {
+			log4go.Info("%s test stream progress, %d keys, duration:%v", name, tested, t.Stop())
+		}
+
+		if err := stream.Send(resp); err != nil {
+			log4go.Warn("send test stream of [%s] error: %v", name, err)
+			return err
+		}
+	}
+}
@@ -11,6 +11,14 @@ import (
 	"github.com/alecthomas/log4go"
 )
 
+const (
+	MIN_ROTATE_INTERVAL = time.Minute
+	MAX_ROTATE_INTERVAL = 4 * 7 * 24 * time.Hour
+
+	MIN_KEY_TTL = time.Minute
+	MAX_KEY_TTL = 4 * 7 * 24 * time.Hour
+)
+
 type BloomFilterService struct {
 	Manager *bloom.FilterManager
 }
@@ -32,14 +40,12 @@ func (b *BloomFilterService) Add(ctx context.Context, req *pb.AddRequest) (*pb.E
 	if len(req.Keys) == 0 {
 		return nil, fmt.Errorf("keys count can't be zero")
 	}
-	filter, err := b.Manager.GetBloomFilter(req.Name)
-	if err != nil {
-		log4go.Warn("get bloomfilter name [%s] error", req.Name)
+	if err := b.Manager.AddKeys(req.Name, req.Keys, !req.Async); err != nil {
+		log4go.Warn("add keys to bloomfilter name [%s] error: %v", req.Name, err)
 		return nil, err
 	}
 
-	bloom.BatchAdd(filter, req.Keys, !req.Async)
-
+	observeAdded(req.Name, len(req.Keys))
 	log4go.Trace("Add keys: %+v", req.Keys)
 	log4go.Info("%s add %d keys,  duration:%v", req.Name, len(req.Keys), t.Stop())
 	return resp, nil
@@ -62,15 +68,185 @@ func (b *BloomFilterService) Test(ctx context.Context, req *pb.TestRequest) (*pb
 		return nil, err
 	}
 
+	if filter, err = scopeFilter(filter, req); err != nil {
+		log4go.Warn("scope bloomfilter name [%s] error: %v", req.Name, err)
+		return nil, err
+	}
+
 	exists := 0
 	resp.Exists, exists = bloom.BatchTest(filter, req.Keys)
+	observeTested(req.Name, len(req.Keys), exists)
 	log4go.Trace("Test keys: %+v", req.Keys)
 	log4go.Info("%s, test %d, left:%d duration:%v", req.Name, len(req.Keys), len(req.Keys)-exists, t.Stop())
 	return resp, nil
 }
 
-func (b *BloomFilterService) Info(ctx context.Context, req *pb.EmptyMessage) (*pb.InfoResponse, error) {
-	return nil, nil
+func (b *BloomFilterService) TestAndAdd(ctx context.Context, req *pb.TestRequest) (*pb.TestResponse, error) {
+	resp := &pb.TestResponse{}
+	t := StartTimer()
+
+	if len(req.Name) == 0 {
+		return nil, fmt.Errorf("empty request name")
+	}
+	if len(req.Keys) == 0 {
+		return nil, fmt.Errorf("keys count can't be zero")
+	}
+
+	scope, err := testScope(req)
+	if err != nil {
+		return nil, err
+	}
+
+	exists := 0
+	resp.Exists, exists, err = b.Manager.TestAndAddKeys(req.Name, req.Keys, scope)
+	if err != nil {
+		log4go.Warn("test and add keys to bloomfilter name [%s] error: %v", req.Name, err)
+		return nil, err
+	}
+	observeTested(req.Name, len(req.Keys), exists)
+	observeAdded(req.Name, len(req.Keys)-exists)
+	log4go.Trace("TestAndAdd keys: %+v", req.Keys)
+	log4go.Info("%s, test and add %d, added:%d duration:%v", req.Name, len(req.Keys), len(req.Keys)-exists, t.Stop())
+	return resp, nil
+}
+
+func (b *BloomFilterService) MultiTest(ctx context.Context, req *pb.MultiTestRequest) (*pb.MultiTestResponse, error) {
+	resp := &pb.MultiTestResponse{}
+	t := StartTimer()
+
+	if len(req.Requests) == 0 {
+		return nil, fmt.Errorf("requests count can't be zero")
+	}
+
+	entries := make([]bloom.MultiEntry, len(req.Requests))
+	for i, r := range req.Requests {
+		scope, err := testScope(r)
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = bloom.MultiEntry{Name: r.Name, Keys: r.Keys, Scope: scope}
+	}
+
+	keys, left := 0, 0
+	for i, result := range b.Manager.MultiTest(entries) {
+		r := &pb.MultiTestResponse_Result{Name: entries[i].Name, Exists: result.Exists}
+		if result.Err != nil {
+			log4go.Warn("multi test bloomfilter name [%s] error: %v", entries[i].Name, result.Err)
+			r.Error = result.Err.Error()
+		} else {
+			observeTested(entries[i].Name, len(entries[i].Keys), result.Count)
+		}
+
+		keys += len(entries[i].Keys)
+		left += len(result.Exists) - result.Count
+		resp.Results = append(resp.Results, r)
+	}
+
+	log4go.Info("multi test %d filters, test %d, left:%d duration:%v", len(entries), keys, left, t.Stop())
+	return resp, nil
+}
+
+func (b *BloomFilterService) MultiAdd(ctx context.Context, req *pb.MultiAddRequest) (*pb.MultiAddResponse, error) {
+	resp := &pb.MultiAddResponse{}
+	t := StartTimer()
+
+	if len(req.Requests) == 0 {
+		return nil, fmt.Errorf("requests count can't be zero")
+	}
+
+	entries := make([]bloom.MultiEntry, len(req.Requests))
+	for i, r := range req.Requests {
+		entries[i] = bloom.MultiEntry{Name: r.Name, Keys: r.Keys, Async: r.Async}
+	}
+
+	keys := 0
+	for i, err := range b.Manager.MultiAdd(entries) {
+		r := &pb.MultiAddResponse_Result{Name: entries[i].Name}
+		if err != nil {
+			log4go.Warn("multi add keys to bloomfilter name [%s] error: %v", entries[i].Name, err)
+			r.Error = err.Error()
+		} else {
+			observeAdded(entries[i].Name, len(entries[i].Keys))
+			keys += len(entries[i].Keys)
+		}
+
+		resp.Results = append(resp.Results, r)
+	}
+
+	log4go.Info("multi add %d filters, add %d keys, duration:%v", len(entries), keys, t.Stop())
+	return resp, nil
+}
+
+func (b *BloomFilterService) Remove(ctx context.Context, req *pb.RemoveRequest) (*pb.RemoveResponse, error) {
+	resp := &pb.RemoveResponse{}
+	t := StartTimer()
+
+	if len(req.Name) == 0 {
+		return nil, fmt.Errorf("empty request name")
+	}
+	if len(req.Keys) == 0 {
+		return nil, fmt.Errorf("keys count can't be zero")
+	}
+
+	var err error
+	removed := 0
+	resp.Removed, removed, err = b.Manager.RemoveKeys(req.Name, req.Keys)
+	if err != nil {
+		log4go.Warn("remove keys from bloomfilter name [%s] error: %v", req.Name, err)
+		return nil, err
+	}
+	log4go.Trace("Remove keys: %+v", req.Keys)
+	log4go.Info("%s, remove %d, removed:%d duration:%v", req.Name, len(req.Keys), removed, t.Stop())
+	return resp, nil
+}
+
+func (b *BloomFilterService) Info(ctx context.Context, req *pb.InfoRequest) (*pb.InfoResponse, error) {
+	infos, err := b.Manager.GetFilterInfos(req.Name)
+	if err != nil {
+		log4go.Warn("get info of filter [%s] error: %v", req.Name, err)
+		return nil, err
+	}
+
+	resp := &pb.InfoResponse{
+		Filters: make([]*pb.FilterInfo, len(infos)),
+	}
+
+	for i, info := range infos {
+		resp.Filters[i] = &pb.FilterInfo{
+			Name:               info.Name,
+			Type:               info.Type,
+			Capacity:           uint64(info.Capacity),
+			ErrorRate:          info.ErrorRate,
+			HashFunc:           uint32(info.K),
+			Keys:               uint64(info.Count),
+			Storage:            info.Storage,
+			FillRatio:          info.FillRatio,
+			EstimatedFillRatio: info.EstimatedFillRatio,
+			Hash:               info.Hash,
+		}
+
+		if info.Type == bloom.FILTER_ROTATED {
+			resp.Filters[i].R = uint32(info.R)
+			resp.Filters[i].Current = uint32(info.Current)
+			resp.Filters[i].Interval = int64(info.RotateInterval / time.Second)
+			resp.Filters[i].LastRotated = info.LastRotated.Unix()
+			resp.Filters[i].WindowStart = info.WindowStart.Unix()
+			resp.Filters[i].NewestOnly = info.NewestOnly
+			if !info.NextRotation.IsZero() {
+				resp.Filters[i].NextRotation = info.NextRotation.Unix()
+			}
+		}
+
+		if info.Type == bloom.FILTER_SCALABLE {
+			resp.Filters[i].Stages = uint32(info.Stages)
+		}
+
+		if info.Type == bloom.FILTER_TTL {
+			resp.Filters[i].TTL = int64(info.TTL / time.Second)
+		}
+	}
+
+	return resp, nil
 }
 
 func (b *BloomFilterService) Dump(ctx context.Context, req *pb.DumpRequest) (*pb.EmptyMessage, error) {
@@ -78,9 +254,94 @@ func (b *BloomFilterService) Dump(ctx context.Context, req *pb.DumpRequest) (*pb
 }
 
 func (b *BloomFilterService) Reload(ctx context.Context, req *pb.ReloadRequest) (*pb.EmptyMessage, error) {
+	if len(req.Path) == 0 {
+		return &pb.EmptyMessage{}, b.Manager.ReloadSnapshot(req.Name, req.Timestamp)
+	}
+
 	return &pb.EmptyMessage{}, b.Manager.ReloadFilter(req.Name, req.Path)
 }
 
+func (b *BloomFilterService) ListSnapshots(ctx context.Context, req *pb.ListSnapshotsRequest) (*pb.ListSnapshotsResponse, error) {
+	snapshots, err := b.Manager.ListSnapshots(req.Name)
+	if err != nil {
+		log4go.Warn("list snapshots of %s error: %v", req.Name, err)
+		return nil, err
+	}
+
+	resp := &pb.ListSnapshotsResponse{
+		Snapshots: make([]*pb.SnapshotInfo, len(snapshots)),
+	}
+
+	for i, snapshot := range snapshots {
+		resp.Snapshots[i] = &pb.SnapshotInfo{
+			Timestamp: snapshot.Timestamp,
+			Size:      snapshot.Size,
+			Current:   snapshot.Current,
+		}
+	}
+
+	return resp, nil
+}
+
+func (b *BloomFilterService) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.EmptyMessage, error) {
+	if len(req.Name) == 0 {
+		return nil, fmt.Errorf("empty request name")
+	}
+
+	if err := b.Manager.DeleteFilter(req.Name); err != nil {
+		log4go.Warn("delete filter %s error: %v", req.Name, err)
+		return nil, err
+	}
+
+	forgetFilterMetrics(req.Name)
+	log4go.Info("delete filter %s success", req.Name)
+	return &pb.EmptyMessage{}, nil
+}
+
+func (b *BloomFilterService) Merge(ctx context.Context, req *pb.MergeRequest) (*pb.EmptyMessage, error) {
+	if len(req.Target) == 0 || len(req.Sources) == 0 {
+		return nil, fmt.Errorf("empty target or sources")
+	}
+
+	op := ""
+	switch req.Op {
+	case pb.MergeRequest_UNION:
+		op = bloom.MERGE_UNION
+	case pb.MergeRequest_INTERSECT:
+		op = bloom.MERGE_INTERSECT
+	default:
+		return nil, fmt.Errorf("unknown merge op :%v", req.Op)
+	}
+
+	if err := b.Manager.MergeFilters(req.Target, req.Sources, op); err != nil {
+		log4go.Warn("merge filters %v into %s error: %v", req.Sources, req.Target, err)
+		return nil, err
+	}
+
+	log4go.Info("merge filters %v into %s success", req.Sources, req.Target)
+	return &pb.EmptyMessage{}, nil
+}
+
+func (b *BloomFilterService) List(ctx context.Context, req *pb.EmptyMessage) (*pb.ListResponse, error) {
+	filters := b.Manager.ListFilters()
+
+	resp := &pb.ListResponse{
+		Filters: make([]*pb.FilterBrief, len(filters)),
+	}
+
+	for i, info := range filters {
+		resp.Filters[i] = &pb.FilterBrief{
+			Name:     info.Name,
+			Type:     info.Type,
+			Capacity: uint64(info.Capacity),
+			Keys:     uint64(info.Count),
+			Storage:  info.Storage,
+		}
+	}
+
+	return resp, nil
+}
+
 func (b *BloomFilterService) Create(ctx context.Context, req *pb.NewBloomFilterRequest) (*pb.EmptyMessage, error) {
 	resp := &pb.EmptyMessage{}
 
@@ -92,6 +353,16 @@ func (b *BloomFilterService) Create(ctx context.Context, req *pb.NewBloomFilterR
 		t = bloom.FILTER_CLASSIC
 	case pb.NewBloomFilterRequest_ROTATED:
 		t = bloom.FILTER_ROTATED
+	case pb.NewBloomFilterRequest_COUNTING:
+		t = bloom.FILTER_COUNTING
+	case pb.NewBloomFilterRequest_SCALABLE:
+		t = bloom.FILTER_SCALABLE
+	case pb.NewBloomFilterRequest_BLOCKED:
+		t = bloom.FILTER_BLOCKED
+	case pb.NewBloomFilterRequest_CUCKOO:
+		t = bloom.FILTER_CUCKOO
+	case pb.NewBloomFilterRequest_TTL:
+		t = bloom.FILTER_TTL
 	default:
 		return nil, fmt.Errorf("unknown filter type :%v", req.Type)
 	}
@@ -108,6 +379,7 @@ func (b *BloomFilterService) Create(ctx context.Context, req *pb.NewBloomFilterR
 		return nil, fmt.Errorf("only permit error_rate between (0,0.1)")
 	}
 	options.ErrorRate = req.ErrorRate
+	options.Hash = req.Hash
 
 	if t == bloom.FILTER_ROTATED {
 		if req.R < 2 || req.R > 30 {
@@ -115,11 +387,31 @@ func (b *BloomFilterService) Create(ctx context.Context, req *pb.NewBloomFilterR
 		}
 		options.R = uint(req.R)
 
-		if req.Interval < 1 || req.Interval > 144 {
-			return nil, fmt.Errorf("rotated filter interval must between [1,144]")
+		interval := time.Hour * time.Duration(req.Interval)
+		if len(req.RotateInterval) > 0 {
+			var err error
+			if interval, err = time.ParseDuration(req.RotateInterval); err != nil {
+				return nil, fmt.Errorf("illegal rotate interval %s: %v", req.RotateInterval, err)
+			}
+		}
+		if interval < MIN_ROTATE_INTERVAL || interval > MAX_ROTATE_INTERVAL {
+			return nil, fmt.Errorf("rotated filter interval must between [%v,%v]", MIN_ROTATE_INTERVAL, MAX_ROTATE_INTERVAL)
 		}
 
-		options.RotateInterval = time.Hour * time.Duration(req.Interval)
+		options.RotateInterval = interval
+		options.NewestOnly = req.NewestOnly
+	}
+
+	if t == bloom.FILTER_TTL {
+		ttl, err := time.ParseDuration(req.KeyTTL)
+		if err != nil {
+			return nil, fmt.Errorf("illegal key ttl %s: %v", req.KeyTTL, err)
+		}
+		if ttl < MIN_KEY_TTL || ttl > MAX_KEY_TTL {
+			return nil, fmt.Errorf("ttl filter key ttl must between [%v,%v]", MIN_KEY_TTL, MAX_KEY_TTL)
+		}
+
+		options.TTL = ttl
 	}
 
 	if _, err := b.Manager.AddNewBloomFilter(t, options); err != nil {
@@ -130,3 +422,27 @@ func (b *BloomFilterService) Create(ctx context.Context, req *pb.NewBloomFilterR
 		return resp, nil
 	}
 }
+
+// testScope returns generations of rotated filter to test by req
+func testScope(req *pb.TestRequest) (bloom.TestScope, error) {
+	scope := bloom.TestScope{Generations: uint(req.Generations)}
+
+	if len(req.Within) > 0 {
+		within, err := time.ParseDuration(req.Within)
+		if err != nil || within <= 0 {
+			return scope, fmt.Errorf("illegal within %s", req.Within)
+		}
+		scope.Within = within
+	}
+
+	return scope, nil
+}
+
+func scopeFilter(filter bloom.Filter, req *pb.TestRequest) (bloom.Filter, error) {
+	scope, err := testScope(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return bloom.ScopeFilter(filter, scope)
+}
@@ -8,17 +8,25 @@ import (
 	jsonpb "github.com/golang/protobuf/jsonpb"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"io"
 	"os"
 	"strings"
+	"time"
     "bufio"
 )
 
 func main() {
-	var addr, cmd, ctx string
+	var addr, cmd, ctx, in, out, op string
+	var batch int
 
 	flag.StringVar(&addr, "addr", ":6066", "rpc server address")
 	flag.StringVar(&cmd, "cmd", "", "sub command")
 	flag.StringVar(&ctx, "ctx", "", "sub command")
+	flag.StringVar(&in, "in", "", "keys file for build and streams, stdin if not set, dump file for query, comma separated dump files for mergedump")
+	flag.IntVar(&batch, "batch", 10000, "keys per request of streams")
+	flag.StringVar(&out, "out", "", "output file for convert, build and mergedump")
+	flag.StringVar(&op, "op", bloom.MERGE_UNION, "union or intersect for mergedump")
+	flag.BoolVar(&bloom.UseGzip, "gzip", true, "compress output of convert, build and mergedump")
 
 	//for create
 	flag.Parse()
@@ -72,19 +80,401 @@ func main() {
 		}
 
 		for i := 0; i < len(req.Keys); i++ {
-			fmt.Println("test %s: %v", req.Keys[i], resp.Exists[i])
+			fmt.Printf("test %s: %v\n", req.Keys[i], resp.Exists[i])
+		}
+	case "testandadd":
+		req := &pb.TestRequest{}
+
+		if err := jsonpb.Unmarshal(strings.NewReader(ctx), req); err != nil {
+			panic(fmt.Sprintf("get context error:%v", err))
+		}
+		resp, err := client.TestAndAdd(context.Background(), req)
+
+		if err != nil {
+			panic(fmt.Sprintf("error: %v", err))
+		}
+
+		for i := 0; i < len(req.Keys); i++ {
+			fmt.Printf("test and add %s: %v\n", req.Keys[i], resp.Exists[i])
+		}
+	case "multitest":
+		req := &pb.MultiTestRequest{}
+		if err := jsonpb.Unmarshal(strings.NewReader(ctx), req); err != nil {
+			panic(fmt.Sprintf("get context error:%v", err))
+		}
+		resp, err := client.MultiTest(context.Background(), req)
+
+		if err != nil {
+			panic(fmt.Sprintf("error: %v", err))
+		}
+
+		for i, result := range resp.Results {
+			if result.Error != "" {
+				fmt.Printf("%s error: %s\n", result.Name, result.Error)
+				continue
+			}
+
+			for j, key := range req.Requests[i].Keys {
+				fmt.Printf("%s test %s: %v\n", result.Name, key, result.Exists[j])
+			}
+		}
+	case "multiadd":
+		req := &pb.MultiAddRequest{}
+		if err := jsonpb.Unmarshal(strings.NewReader(ctx), req); err != nil {
+			panic(fmt.Sprintf("get context error:%v", err))
+		}
+		resp, err := client.MultiAdd(context.Background(), req)
+
+		if err != nil {
+			panic(fmt.Sprintf("error: %v", err))
+		}
+
+		for _, result := range resp.Results {
+			if result.Error != "" {
+				fmt.Printf("%s error: %s\n", result.Name, result.Error)
+			} else {
+				fmt.Printf("%s add success\n", result.Name)
+			}
+		}
+	case "addstream":
+		req := &pb.AddRequest{}
+		if err := jsonpb.Unmarshal(strings.NewReader(ctx), req); err != nil {
+			panic(fmt.Sprintf("get context error:%v", err))
+		}
+
+		stream, err := client.AddStream(context.Background())
+		if err != nil {
+			panic(fmt.Sprintf("error: %v", err))
+		}
+
+		if err := scanBatches(in, batch, func(keys []string) error {
+			req.Keys = keys
+			return stream.Send(req)
+		}); err != nil {
+			panic(fmt.Sprintf("send error: %v", err))
+		}
+
+		resp, err := stream.CloseAndRecv()
+		if err != nil {
+			panic(fmt.Sprintf("error: %v", err))
+		}
+		fmt.Printf("added %d keys by %d requests\n", resp.Keys, resp.Requests)
+	case "teststream":
+		req := &pb.TestRequest{}
+		if err := jsonpb.Unmarshal(strings.NewReader(ctx), req); err != nil {
+			panic(fmt.Sprintf("get context error:%v", err))
+		}
+
+		stream, err := client.TestStream(context.Background())
+		if err != nil {
+			panic(fmt.Sprintf("error: %v", err))
+		}
+
+		// responses come in order of requests
+		sent := make(chan []string, 16)
+		go func() {
+			defer close(sent)
+			if err := scanBatches(in, batch, func(keys []string) error {
+				sent <- keys
+				return stream.Send(&pb.TestRequest{Name: req.Name, Keys: keys})
+			}); err != nil {
+				panic(fmt.Sprintf("send error: %v", err))
+			}
+			stream.CloseSend()
+		}()
+
+		var resp *pb.TestStreamResponse
+		for keys := range sent {
+			if resp, err = stream.Recv(); err != nil {
+				panic(fmt.Sprintf("error: %v", err))
+			}
+
+			for i, key := range keys {
+				fmt.Printf("test %s: %v\n", key, resp.Exists[i])
+			}
+		}
+
+		if resp != nil {
+			fmt.Printf("tested %d keys, %d existed\n", resp.Tested, resp.Existed)
+		}
+	case "remove":
+		req := &pb.RemoveRequest{}
+
+		if err := jsonpb.Unmarshal(strings.NewReader(ctx), req); err != nil {
+			panic(fmt.Sprintf("get context error:%v", err))
+		}
+		resp, err := client.Remove(context.Background(), req)
+
+		if err != nil {
+			panic(fmt.Sprintf("error: %v", err))
+		}
+
+		for i := 0; i < len(req.Keys); i++ {
+			fmt.Printf("remove %s: %v\n", req.Keys[i], resp.Removed[i])
+		}
+	case "info":
+		req := &pb.InfoRequest{}
+		if ctx != "" {
+			if err := jsonpb.Unmarshal(strings.NewReader(ctx), req); err != nil {
+				panic(fmt.Sprintf("get context error:%v", err))
+			}
+		}
+		resp, err := client.Info(context.Background(), req)
+
+		if err != nil {
+			panic(fmt.Sprintf("error: %v", err))
+		}
+
+		m := jsonpb.Marshaler{Indent: "  "}
+		if s, err := m.MarshalToString(resp); err != nil {
+			panic(fmt.Sprintf("marshal error: %v", err))
+		} else {
+			fmt.Println(s)
+		}
+	case "delete":
+		req := &pb.DeleteRequest{}
+		if err := jsonpb.Unmarshal(strings.NewReader(ctx), req); err != nil {
+			panic(fmt.Sprintf("get context error:%v", err))
+		}
+		_, err := client.Delete(context.Background(), req)
+
+		if err != nil {
+			panic(fmt.Sprintf("error: %v", err))
+		}
+		fmt.Println("delete bloomfilter success")
+	case "list":
+		resp, err := client.List(context.Background(), &pb.EmptyMessage{})
+
+		if err != nil {
+			panic(fmt.Sprintf("error: %v", err))
+		}
+
+		for _, f := range resp.Filters {
+			fmt.Printf("%s\t%s\tcapacity:%d\tkeys:%d\tstorage:%d\n", f.Name, f.Type, f.Capacity, f.Keys, f.Storage)
+		}
+	case "merge":
+		req := &pb.MergeRequest{}
+		if err := jsonpb.Unmarshal(strings.NewReader(ctx), req); err != nil {
+			panic(fmt.Sprintf("get context error:%v", err))
+		}
+		_, err := client.Merge(context.Background(), req)
+
+		if err != nil {
+			panic(fmt.Sprintf("error: %v", err))
+		}
+		fmt.Println("merge bloomfilter success")
+	case "mergedump":
+		if out == "" {
+			panic("please set out")
+		}
+
+		// the first dump is the target
+		var target bloom.Filter
+		for _, path := range strings.Split(in, ",") {
+			f, err := os.Open(path)
+			if err != nil {
+				panic(fmt.Sprintf("open file error: %v", err))
+			}
+
+			filter, _, err := bloom.LoadDump(bufio.NewReader(f))
+			f.Close()
+			if err != nil {
+				panic(fmt.Sprintf("load dump %s error: %v", path, err))
+			}
+
+			if target == nil {
+				target = filter
+			} else if err := bloom.MergeFilter(target, filter, op); err != nil {
+				panic(fmt.Sprintf("merge %s error: %v", path, err))
+			}
+		}
+
+		if err := writeFile(out, func(w io.Writer) error {
+			return bloom.WriteDump(w, target)
+		}); err != nil {
+			panic(fmt.Sprintf("dump error: %v", err))
+		}
+		fmt.Printf("merged %s into %s\n", in, out)
+	case "snapshots":
+		req := &pb.ListSnapshotsRequest{}
+		if err := jsonpb.Unmarshal(strings.NewReader(ctx), req); err != nil {
+			panic(fmt.Sprintf("get context error:%v", err))
+		}
+		resp, err := client.ListSnapshots(context.Background(), req)
+
+		if err != nil {
+			panic(fmt.Sprintf("error: %v", err))
+		}
+
+		for _, s := range resp.Snapshots {
+			current := ""
+			if s.Current {
+				current = "*"
+			}
+			fmt.Printf("%d\t%v\tsize:%d\t%s\n", s.Timestamp, time.Unix(s.Timestamp, 0), s.Size, current)
 		}
 	case "check":
 		f, err := os.Open(ctx)
 		if err == nil {
-			if err := bloom.CheckFilter(bufio.NewReader(f)); err != nil {
-				fmt.Println("filter format error :%v", err)
+			header, err := bloom.CheckDump(bufio.NewReader(f))
+			if header != nil {
+				fmt.Printf("type:%s version:%d gzip:%v\n", header.FilterType, header.Version, header.FilterUsedGzip)
+				if header.Version < bloom.DUMP_VERSION_CHECKSUM {
+					fmt.Println("legacy dump without checksum")
+				}
+			}
+
+			if err == bloom.CHECKSUM_ERROR {
+				fmt.Println("checksum mismatch, file is corrupted")
+			} else if err != nil {
+				fmt.Printf("filter format error :%v\n", err)
 			} else {
 				fmt.Println("file format check ok")
 			}
 		} else {
 			fmt.Println("open file error")
 		}
+	case "convert":
+		if out == "" {
+			panic("please set out")
+		}
+
+		f, err := os.Open(ctx)
+		if err != nil {
+			panic(fmt.Sprintf("open file error: %v", err))
+		}
+		defer f.Close()
+
+		var header *bloom.DumpHeader
+		if err := writeFile(out, func(w io.Writer) (err error) {
+			header, err = bloom.ConvertDump(bufio.NewReader(f), w)
+			return err
+		}); err != nil {
+			panic(fmt.Sprintf("convert error: %v", err))
+		}
+		fmt.Printf("converted %s filter from version %d to %d\n", header.FilterType, header.Version, bloom.DUMP_VERSION)
+	case "build":
+		req := &pb.NewBloomFilterRequest{}
+		if err := jsonpb.Unmarshal(strings.NewReader(ctx), req); err != nil {
+			panic(fmt.Sprintf("get context error:%v", err))
+		}
+		if out == "" {
+			panic("please set out")
+		}
+
+		options := bloom.FilterOptions{
+			Name:           req.Name,
+			N:              uint(req.N),
+			ErrorRate:      req.ErrorRate,
+			Hash:           req.Hash,
+			R:              uint(req.R),
+			RotateInterval: time.Hour * time.Duration(req.Interval),
+			NewestOnly:     req.NewestOnly,
+		}
+		if req.RotateInterval != "" {
+			interval, err := time.ParseDuration(req.RotateInterval)
+			if err != nil {
+				panic(fmt.Sprintf("illegal rotate interval: %v", err))
+			}
+			options.RotateInterval = interval
+		}
+		if req.KeyTTL != "" {
+			ttl, err := time.ParseDuration(req.KeyTTL)
+			if err != nil {
+				panic(fmt.Sprintf("illegal key ttl: %v", err))
+			}
+			options.TTL = ttl
+		}
+
+		t := ""
+		switch req.Type {
+		case pb.NewBloomFilterRequest_CLASSIC:
+			t = bloom.FILTER_CLASSIC
+		case pb.NewBloomFilterRequest_ROTATED:
+			t = bloom.FILTER_ROTATED
+		case pb.NewBloomFilterRequest_COUNTING:
+			t = bloom.FILTER_COUNTING
+		case pb.NewBloomFilterRequest_SCALABLE:
+			t = bloom.FILTER_SCALABLE
+		case pb.NewBloomFilterRequest_BLOCKED:
+			t = bloom.FILTER_BLOCKED
+		case pb.NewBloomFilterRequest_CUCKOO:
+			t = bloom.FILTER_CUCKOO
+		case pb.NewBloomFilterRequest_TTL:
+			t = bloom.FILTER_TTL
+		}
+
+		filter, err := bloom.NewFilter(t, options)
+		if err != nil {
+			panic(fmt.Sprintf("create filter error: %v", err))
+		}
+
+		keys := 0
+		if err := scanKeys(in, func(key []byte) {
+			filter.Add(key)
+			keys++
+		}); err != nil {
+			panic(fmt.Sprintf("read keys error: %v", err))
+		}
+
+		if err := writeFile(out, func(w io.Writer) error {
+			return bloom.WriteDump(w, filter)
+		}); err != nil {
+			panic(fmt.Sprintf("dump error: %v", err))
+		}
+		fmt.Printf("built %s filter %s with %d keys, reload it from %s\n", t, req.Name, keys, out)
+	case "inspect":
+		f, err := os.Open(ctx)
+		if err != nil {
+			panic(fmt.Sprintf("open file error: %v", err))
+		}
+		defer f.Close()
+
+		filter, header, err := bloom.LoadDump(bufio.NewReader(f))
+		if header != nil {
+			fmt.Printf("header: %+v\n", *header)
+		}
+		if err != nil {
+			panic(fmt.Sprintf("load dump error: %v", err))
+		}
+
+		printFilter("", filter)
+
+		for i, sub := range bloom.SubFilters(filter) {
+			printFilter(fmt.Sprintf("  #%d ", i), sub)
+		}
+	case "query":
+		req := &pb.TestRequest{}
+		if err := jsonpb.Unmarshal(strings.NewReader(ctx), req); err != nil {
+			panic(fmt.Sprintf("get context error:%v", err))
+		}
+
+		f, err := os.Open(in)
+		if err != nil {
+			panic(fmt.Sprintf("open file error: %v", err))
+		}
+		defer f.Close()
+
+		filter, _, err := bloom.LoadDump(bufio.NewReader(f))
+		if err != nil {
+			panic(fmt.Sprintf("load dump error: %v", err))
+		}
+
+		subs := bloom.SubFilters(filter)
+		for _, key := range req.Keys {
+			hits := make([]int, 0)
+			for i, sub := range subs {
+				if sub.Test([]byte(key)) {
+					hits = append(hits, i)
+				}
+			}
+
+			if len(subs) > 0 {
+				fmt.Printf("test %s: %v, hit sub filters: %v\n", key, filter.Test([]byte(key)), hits)
+			} else {
+				fmt.Printf("test %s: %v\n", key, filter.Test([]byte(key)))
+			}
+		}
 	case "dump":
 		req := &pb.DumpRequest{}
 		if err := jsonpb.Unmarshal(strings.NewReader(ctx), req); err != nil {
@@ -108,3 +498,93 @@ func main() {
 	}
 
 }
+
+// scanKeys calls fn with each non empty line of file, or stdin if file is empty
+func scanKeys(file string, fn func(key []byte)) error {
+	input := os.Stdin
+	if file != "" {
+		var err error
+		if input, err = os.Open(file); err != nil {
+			return err
+		}
+		defer input.Close()
+	}
+
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if key := scanner.Bytes(); len(key) > 0 {
+			fn(key)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// scanBatches calls fn with keys of file by batches of size
+func scanBatches(file string, size int, fn func(keys []string) error) error {
+	keys := make([]string, 0, size)
+	var err error
+
+	if e := scanKeys(file, func(key []byte) {
+		if err != nil {
+			return
+		}
+
+		keys = append(keys, string(key))
+		if len(keys) >= size {
+			err = fn(keys)
+			keys = make([]string, 0, size)
+		}
+	}); e != nil {
+		return e
+	}
+
+	if err == nil && len(keys) > 0 {
+		err = fn(keys)
+	}
+	return err
+}
+
+// writeFile writes to a temp file then renames it to path, so a half written
+// file is never reloaded
+func writeFile(path string, fn func(w io.Writer) error) error {
+	tmp := path + bloom.TMP_SUFFIX
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	err = fn(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	f.Close()
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func printFilter(prefix string, filter bloom.Filter) {
+	info := bloom.GetFilterInfo(filter)
+	fmt.Printf("%sname:%s type:%s capacity:%d k:%d hash:%s keys:%d error_rate:%v storage:%d\n",
+		prefix, info.Name, info.Type, info.Capacity, info.K, info.Hash, info.Count, info.ErrorRate, info.Storage)
+	fmt.Printf("%sfill_ratio:%.6f estimated_fill_ratio:%.6f estimated_fp_rate:%.6g\n",
+		prefix, info.FillRatio, info.EstimatedFillRatio, bloom.EstimatedFalsePositiveRate(filter))
+
+	switch info.Type {
+	case bloom.FILTER_ROTATED:
+		fmt.Printf("%sr:%d current:%d rotate_interval:%v last_rotated:%v\n",
+			prefix, info.R, info.Current, info.RotateInterval, info.LastRotated)
+		fmt.Printf("%swindow_start:%v next_rotation:%v newest_only:%v\n", prefix, info.WindowStart, info.NextRotation, info.NewestOnly)
+	case bloom.FILTER_SCALABLE:
+		fmt.Printf("%sstages:%d\n", prefix, info.Stages)
+	case bloom.FILTER_TTL:
+		fmt.Printf("%sttl:%v\n", prefix, info.TTL)
+	}
+}